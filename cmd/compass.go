@@ -1,39 +1,42 @@
 package cmd
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
+	"path/filepath"
+	"time"
 
 	"github.com/monax/compass/core"
-	"github.com/monax/compass/core/schema"
-	"github.com/monax/compass/docker"
-	"github.com/monax/compass/helm"
 	"github.com/monax/compass/kube"
 	"github.com/monax/compass/util"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	yaml "gopkg.in/yaml.v3"
 )
 
 var (
-	k8s          *kube.K8s
-	templates    []string
-	inValues     map[string]string
-	outValues    util.Values
-	destroy      bool
-	force        bool
-	tillerName   string
-	tillerPort   string
-	until        string
-	namespace    string
-	kubeConfig   string
-	helmConfig   string
-	shortVersion bool
-	toEnv        bool
+	k8s             *kube.K8s
+	templates       []string
+	inValues        map[string]string
+	outValues       util.Values
+	destroy         bool
+	force           bool
+	dryRun          bool
+	resume          bool
+	parallel        int
+	parallelObjects int
+	grace           time.Duration
+	onFailure       string
+	stateLocation   string
+	tillerName      string
+	tillerPort      string
+	until           []string
+	selection       core.Selection
+	namespace       string
+	kubeConfig      string
+	helmConfig      string
+	shortVersion    bool
+	toEnv           bool
 )
 
 var rootCmd = &cobra.Command{
@@ -87,78 +90,43 @@ var runCmd = &cobra.Command{
 	SilenceUsage: true,
 	Args:         cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
-		spec := args[0]
-		ctx := context.Background()
-		workflow := schema.NewWorkflow()
+		ctx, halt, stop := interruptible(grace)
+		defer stop()
 
-		var data []byte
-		if data, err = util.RenderFile(spec, outValues, core.RenderWith(k8s)); err != nil {
-			return err
-		}
-		if err = yaml.Unmarshal([]byte(data), &workflow); err != nil {
+		k8s.DryRun = dryRun
+		workflow, err := loadWorkflow(ctx, args[0], !dryRun, halt)
+		if err != nil {
 			return err
 		}
-		workflow.Values.Append(outValues)
-
-		// do builds and fetch tags
-		shas := make(map[string]string, len(workflow.Build)+len(workflow.Tag))
-		for _, img := range workflow.Build {
-			shas[img.Name], err = docker.BuildAndPush(ctx, img)
-			if err != nil {
-				return err
-			}
-		}
-		for _, img := range workflow.Tag {
-			shas[img.Name], err = docker.GetImageDigest(img.Reference)
-			if err != nil {
-				return err
-			}
-		}
-
-		// we want those shas before we
-		// template the main workflow
-		workflow.Values.AppendStr(shas)
 
-		tiller, err := helm.NewClient(k8s, helmConfig, tillerName, tillerPort)
+		tiller, err := connectWorkflow(workflow)
 		if err != nil {
 			return err
 		}
 		defer tiller.Close()
+		tiller.DryRun = dryRun
 
-		if err = core.Connect(workflow, k8s, tiller, workflow.Values); err != nil {
-			return err
-		}
-
-		if err = core.Lint(workflow, workflow.Values); err != nil {
+		opts, err := runOptions(workflow)
+		if err != nil {
 			return err
 		}
-
-		force := force
-		if len(workflow.Stages) == 0 {
-			return fmt.Errorf("nothing to run")
-		}
-
-		c := make(chan os.Signal)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			<-c
-			os.Exit(1)
-		}()
+		opts.Halt = halt
+		opts.DryRun = dryRun
+		opts.Scroll = filepath.Clean(args[0])
+		opts.Resume = resume
 
 		// reverse workflow
 		if destroy {
-			core.Backward(workflow.Stages, workflow.Values, force)
-			return nil
+			return core.Backward(ctx, workflow.Stages, workflow.Values, opts)
 		}
 
 		// stop at desired key
-		if until != "" {
-			core.Until(workflow.Stages, workflow.Values, force, until)
-			return nil
+		if len(until) > 0 {
+			return core.Until(ctx, workflow.Stages, workflow.Values, opts, until...)
 		}
 
 		// run full workflow
-		return core.Forward(workflow.Stages, workflow.Values, force)
+		return core.Forward(ctx, workflow.Stages, workflow.Values, opts)
 	},
 }
 
@@ -182,10 +150,18 @@ var kubeCmd = &cobra.Command{
 			K8s:       k8s,
 		}
 
-		if err = man.InstallOrUpgrade(); err != nil {
+		ctx, _, stop := interruptible(grace)
+		defer stop()
+
+		k8s.DryRun = dryRun
+		if err = man.InstallOrUpgrade(ctx); err != nil {
 			return err
 		}
 
+		if dryRun {
+			log.Info("Validated successfully")
+			return nil
+		}
 		log.Info("Deployed successfully")
 		return nil
 	},
@@ -196,15 +172,19 @@ func init() {
 	rootCmd.PersistentFlags().StringArrayVarP(&templates, "template", "t", nil, "file with key:value mappings")
 	rootCmd.PersistentFlags().StringToStringVar(&inValues, "value", nil, "explicit key=value pairs")
 
-	runCmd.Flags().BoolVarP(&destroy, "destroy", "d", false, "purge all stages, top-down")
-	runCmd.Flags().BoolVarP(&force, "force", "f", false, "force install / upgrade / delete")
-	runCmd.Flags().StringVar(&helmConfig, "helm-config", "", "helm config")
-	runCmd.Flags().StringVarP(&tillerName, "tillerName", "n", "kube-system", "namespace to search for Tiller")
-	runCmd.Flags().StringVarP(&tillerPort, "tillerPort", "p", "44134", "port to connect on Tiller")
-	runCmd.Flags().StringVarP(&until, "until", "u", "", "only deploy stage and dependencies")
+	addWorkflowFlags(runCmd)
+	runCmd.Flags().StringSliceVarP(&until, "until", "u", nil, "only deploy the given stages and their dependencies")
+	runCmd.Flags().BoolVar(&dryRun, "dry-run", false, "simulate the workflow without changing anything")
+	runCmd.Flags().DurationVar(&grace, "grace", 30*time.Second, "time to wait for running stages after an interrupt")
+	runCmd.Flags().IntVar(&parallel, "parallel", 0, "maximum stages to run at once (default unlimited)")
+	runCmd.Flags().IntVar(&parallelObjects, "parallel-objects", 0, "maximum objects to apply at once per manifest (default unlimited)")
+	runCmd.Flags().BoolVar(&resume, "resume", false, "only run stages which failed or never started in the previous run (requires --state)")
+	runCmd.Flags().StringVar(&onFailure, "on-failure", "", "failure policy for stages without their own (abort, continue, rollback)")
 	rootCmd.AddCommand(runCmd)
 
 	kubeCmd.Flags().StringVarP(&namespace, "namespace", "n", "", "namespace to deploy")
+	kubeCmd.Flags().BoolVar(&dryRun, "dry-run", false, "validate the objects with the server without persisting them")
+	kubeCmd.Flags().DurationVar(&grace, "grace", 30*time.Second, "time to wait for running objects after an interrupt")
 	rootCmd.AddCommand(kubeCmd)
 
 	outputCmd.Flags().BoolVarP(&toEnv, "to-env", "e", false, "output the finalized values into environment variables")
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/monax/compass/core"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show what the given workflow would change",
+	Long:  "Compare the live state of each stage with what a run would deploy.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		ctx, halt, stop := interruptible(grace)
+		defer stop()
+
+		workflow, err := loadWorkflow(ctx, args[0], false, halt)
+		if err != nil {
+			return err
+		}
+
+		tiller, err := connectWorkflow(workflow)
+		if err != nil {
+			return err
+		}
+		defer tiller.Close()
+
+		opts, err := runOptions(workflow)
+		if err != nil {
+			return err
+		}
+
+		steps, err := core.Plan(ctx, workflow.Stages, workflow.Values, opts, false)
+		if err != nil {
+			return err
+		}
+
+		deferred := core.Deferred(workflow.Stages)
+		for _, step := range steps {
+			fmt.Printf("==> %s (%s)\n", step.Stage, step.Kind)
+			if step.Action == core.Skip {
+				fmt.Printf("skipped: %s\n\n", step.Reason)
+				continue
+			} else if deferred[step.Stage] {
+				fmt.Printf("unknown: rendered when the stage runs\n\n")
+				continue
+			}
+
+			out, err := workflow.Stages[step.Stage].Diff(ctx)
+			if err != nil {
+				return fmt.Errorf("couldn't diff %s: %v", step.Stage, err)
+			} else if out == "" {
+				out = "no changes\n"
+			}
+			fmt.Println(out)
+		}
+		return nil
+	},
+}
+
+func init() {
+	diffCmd.Flags().BoolVarP(&force, "force", "f", false, "include forgotten stages")
+	addHelmFlags(diffCmd)
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/monax/compass/core"
+	"github.com/spf13/cobra"
+)
+
+var format string
+
+var graphCmd = &cobra.Command{
+	Use:   "graph",
+	Short: "Export the dependency graph of the given workflow",
+	Long:  "Render the stages of a workflow and their dependencies as Graphviz DOT, Mermaid or JSON.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		ctx, halt, stop := interruptible(grace)
+		defer stop()
+
+		workflow, err := loadWorkflow(ctx, args[0], false, halt)
+		if err != nil {
+			return err
+		}
+
+		// cascade the release and namespace of each stage
+		if err = core.Lint(workflow, workflow.Values); err != nil {
+			return err
+		}
+
+		graph, err := core.Graph(workflow.Stages, workflow.Values, core.RenderWith(k8s))
+		if err != nil {
+			return err
+		}
+
+		switch format {
+		case "dot", "":
+			fmt.Print(core.DOT(graph))
+		case "mermaid":
+			fmt.Print(core.Mermaid(graph))
+		case "json":
+			out, err := json.MarshalIndent(graph, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+		default:
+			return fmt.Errorf("graph format '%s' unknown", format)
+		}
+		return nil
+	},
+}
+
+func init() {
+	graphCmd.Flags().StringVarP(&format, "format", "o", "dot", "output format (dot, mermaid, json)")
+	rootCmd.AddCommand(graphCmd)
+}
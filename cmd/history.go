@@ -10,7 +10,44 @@ import (
 var commit string
 
 var History relic.ImmutableHistory = relic.NewHistory("Compass", "https://github.com/monax/compass").
-	MustDeclareReleases("", ``,
+	MustDeclareReleases("",
+		`
+		### Changed
+		- Failed stages no longer exit the process, dependent stages are skipped and a summary is reported
+		- --until runs every transitive dependency of the target and accepts multiple targets (--until a,b)
+		- Requirements compare values as text, so add: true in a scroll matches add=true given on the command line
+		- Checking a helm release no longer changes it, deleted or never deployed releases are purged before they are installed and pending ones are waited on, then reported as locked
+
+		### Added
+		- Failure policies (abort, continue, rollback) per workflow, stage or with --on-failure
+		- Interrupts stop new stages and wait for running ones, a second interrupt aborts them
+		- Plan command to preview what a run would install, upgrade, delete or skip
+		- Dry run mode for run and kube commands
+		- Diff command to compare live objects and releases with the rendered workflow
+		- State store (--state) to record applied stages and skip those that have not changed
+		- Resume (--resume) a failed run, only running stages which failed or never started
+		- Stage labels and selection with --only, --exclude, --selector and --with-deps
+		- Bounded parallelism for stages and objects with a workflow concurrency setting, --parallel or --parallel-objects
+		- Graph command to export the stage dependencies as DOT, Mermaid or JSON
+		- Validate command to report mistakes in a scroll by line, such as unknown keys or missing templates
+		- Schema command to output a JSON Schema of the scroll format for editors
+		- Stage outputs, read from objects, releases or jobs, for the templates of dependent stages
+		- Lazy rendering (render: lazy) per stage or workflow so templates can read objects created by earlier stages
+		- Conditional stages with a when template, skipped stages still satisfy their dependants
+		- Foreach stages which expand into one instance per item, with .item and .index in their templates
+		- Imports of other scrolls, from local paths or git repositories, with their stages prefixed by name
+		- Workflow stages (kind: workflow) which run another scroll as a nested set of stages, with the options and state of the parent run
+		- Helm 3 releases (helm: 3) per workflow or stage, without Tiller, and a migrate command to move releases from Helm 2
+		- Kube stages apply custom resources and cluster scoped objects, and wait for workloads to roll out with wait: true
+		- Atomic charts (atomic: true) which wait for their upgrades and roll back to the last successful revision when one fails
+		- Rollback and history commands to list and return to earlier revisions of a helm or kube stage, kube manifests with secrets are only kept in a secret or file state
+
+		### Fixed
+		- Unknown dependencies no longer panic, they are reported with suggestions along with the path of any dependency cycle
+		- README examples use forget, template and name rather than the unsupported abandon, input and repository
+		- The history of helm 2 releases is read in full, so a failed upgrade is no longer mistaken for a failed install
+		`,
+
 		"0.5.4 - 2019-09-24",
 		`
 		### Fixed
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/monax/compass/helm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var cleanup bool
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate [release...]",
+	Short: "Move helm 2 releases to helm 3",
+	Long:  "Copy the history of each release from the config maps or secrets of tiller into helm 3 secrets, so its stages can set helm: 3.",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, name := range args {
+			revisions, err := helm.Migrate(k8s, name, tillerName, cleanup, dryRun)
+			if err != nil {
+				return fmt.Errorf("couldn't migrate %s: %v", name, err)
+			} else if dryRun {
+				log.Infof("Would migrate: %s (%d revisions)", name, revisions)
+				continue
+			}
+			log.Infof("Migrated: %s (%d revisions)", name, revisions)
+		}
+		return nil
+	},
+}
+
+func init() {
+	migrateCmd.Flags().StringVarP(&tillerName, "tillerName", "n", "kube-system", "namespace to search for Tiller")
+	migrateCmd.Flags().BoolVar(&cleanup, "cleanup", false, "remove the records of tiller once moved")
+	migrateCmd.Flags().BoolVar(&dryRun, "dry-run", false, "only report what would be moved")
+	rootCmd.AddCommand(migrateCmd)
+}
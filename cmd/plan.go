@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/monax/compass/core"
+	"github.com/spf13/cobra"
+)
+
+var output string
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show what the given workflow would do",
+	Long:  "Work out which stages a run would install, upgrade, delete or skip without changing anything.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		ctx, halt, stop := interruptible(grace)
+		defer stop()
+
+		workflow, err := loadWorkflow(ctx, args[0], false, halt)
+		if err != nil {
+			return err
+		}
+
+		tiller, err := connectWorkflow(workflow)
+		if err != nil {
+			return err
+		}
+		defer tiller.Close()
+
+		opts, err := runOptions(workflow)
+		if err != nil {
+			return err
+		}
+
+		steps, err := core.Plan(ctx, workflow.Stages, workflow.Values, opts, destroy)
+		if err != nil {
+			return err
+		}
+
+		switch output {
+		case "json":
+			out, err := json.MarshalIndent(steps, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+		case "text", "":
+			fmt.Print(core.Summary(steps))
+		default:
+			return fmt.Errorf("output format '%s' unknown", output)
+		}
+		return nil
+	},
+}
+
+func init() {
+	addWorkflowFlags(planCmd)
+	planCmd.Flags().StringVarP(&output, "output", "o", "text", "output format (text, json)")
+	rootCmd.AddCommand(planCmd)
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/monax/compass/core"
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var toRevision int
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback <scroll> <stage>",
+	Short: "Undo the last release of a stage",
+	Long:  "Roll a helm stage back to an earlier revision of its release, or apply the manifest of a kube stage from an earlier run.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, halt, stop := interruptible(grace)
+		defer stop()
+
+		stg, tiller, err := loadStage(ctx, args[0], args[1], halt)
+		if err != nil {
+			return err
+		}
+		defer tiller.Close()
+
+		store, err := openState()
+		if err != nil {
+			return err
+		}
+		if err = core.Revert(ctx, args[1], stg, store, toRevision); err != nil {
+			return fmt.Errorf("couldn't roll back %s: %v", args[1], err)
+		}
+		log.Infof("Rolled back: %s", args[1])
+		return nil
+	},
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history <scroll> <stage>",
+	Short: "List the revisions of a stage",
+	Long:  "Show each revision of a helm release, or each recorded run of a kube stage, which rollback can return to.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, halt, stop := interruptible(grace)
+		defer stop()
+
+		stg, tiller, err := loadStage(ctx, args[0], args[1], halt)
+		if err != nil {
+			return err
+		}
+		defer tiller.Close()
+
+		st := state.New()
+		if store, err := openState(); err != nil {
+			return err
+		} else if store != nil {
+			if st, err = store.Load(); err != nil {
+				return fmt.Errorf("couldn't load state: %v", err)
+			}
+		}
+
+		revisions, err := core.History(ctx, args[1], stg, st)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REVISION\tUPDATED\tSTATUS\tVERSION\tDESCRIPTION")
+		for _, rev := range revisions {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", rev.Revision, rev.Updated.Format(time.RFC3339), rev.Status, rev.Version, rev.Description)
+		}
+		return w.Flush()
+	},
+}
+
+// loadStage renders the scroll and connects the given stage
+func loadStage(ctx context.Context, spec, key string, halt <-chan struct{}) (*schema.Stage, *helm.Tiller, error) {
+	workflow, err := loadWorkflow(ctx, spec, false, halt)
+	if err != nil {
+		return nil, nil, err
+	}
+	stg, ok := workflow.Stages[key]
+	if !ok {
+		keys := make([]string, 0, len(workflow.Stages))
+		for k := range workflow.Stages {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return nil, nil, fmt.Errorf("stage %s not found in %s, expected one of: %s", key, spec, strings.Join(keys, ", "))
+	}
+
+	tiller, err := connectWorkflow(workflow)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stg, tiller, nil
+}
+
+func init() {
+	rollbackCmd.Flags().IntVar(&toRevision, "to-revision", 0, "revision of the release, or run of a kube stage, to return to (defaults to the one before the last)")
+	rollbackCmd.Flags().StringVar(&stateLocation, "state", "", "where applied stages are recorded (file://path, configmap://ns/name or secret://ns/name)")
+	addHelmFlags(rollbackCmd)
+	rootCmd.AddCommand(rollbackCmd)
+
+	historyCmd.Flags().StringVar(&stateLocation, "state", "", "where applied stages are recorded (file://path, configmap://ns/name or secret://ns/name)")
+	addHelmFlags(historyCmd)
+	rootCmd.AddCommand(historyCmd)
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/spf13/cobra"
+)
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Output the JSON Schema for scrolls",
+	Long:  "Print a JSON Schema describing the scroll format, for editors to autocomplete and validate workflows.",
+	Args:  cobra.NoArgs,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// no need to connect to kubernetes
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, err := json.MarshalIndent(schema.JSONSchema(), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// interruptible returns a context which is cancelled on a second signal, or
+// once the grace period after the first has expired, and a channel which is
+// closed on the first signal so that no new work is started
+func interruptible(grace time.Duration) (context.Context, <-chan struct{}, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	halt := make(chan struct{})
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-sigs:
+		case <-ctx.Done():
+			return
+		}
+		log.Warnf("Interrupted, waiting %s for running stages to finish (repeat to abort)", grace)
+		close(halt)
+
+		select {
+		case <-sigs:
+			log.Warn("Aborting")
+		case <-time.After(grace):
+			log.Warn("Grace period expired, aborting")
+		case <-ctx.Done():
+			return
+		}
+		cancel()
+	}()
+
+	return ctx, halt, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
+
+// halted returns true if the channel has been closed
+func halted(halt <-chan struct{}) bool {
+	select {
+	case <-halt:
+		return true
+	default:
+		return false
+	}
+}
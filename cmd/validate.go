@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/monax/compass/core"
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/util"
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the given workflow for mistakes",
+	Long:  "Check the structure of a workflow, reporting unknown keys, wrong types and missing stages or templates by line.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, _, stop := interruptible(grace)
+		defer stop()
+
+		spec := args[0]
+		data, err := util.RenderFile(spec, outValues, core.RenderWith(k8s))
+		if err != nil {
+			return err
+		}
+
+		imported, err := core.Imported(ctx, data, spec, outValues, core.RenderWith(k8s))
+		if err != nil {
+			return fmt.Errorf("%s: %v", spec, err)
+		}
+		problems, err := schema.Check(data, imported...)
+		if err != nil {
+			return fmt.Errorf("%s: %v", spec, err)
+		}
+		for _, p := range problems {
+			fmt.Printf("%s:%s\n", spec, p)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("found %d problem(s) in %s", len(problems), spec)
+		}
+		fmt.Printf("%s is valid\n", spec)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/monax/compass/core"
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/docker"
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/state"
+	"github.com/monax/compass/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// addWorkflowFlags registers the flags shared by commands which run a scroll
+func addWorkflowFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&destroy, "destroy", "d", false, "purge all stages, top-down")
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "force install / upgrade / delete")
+	cmd.Flags().StringSliceVar(&selection.Only, "only", nil, "only run the given stages")
+	cmd.Flags().StringSliceVar(&selection.Exclude, "exclude", nil, "do not run the given stages")
+	cmd.Flags().StringVarP(&selection.Selector, "selector", "l", "", "only run stages with matching labels (e.g. tier=backend)")
+	cmd.Flags().BoolVar(&selection.WithDeps, "with-deps", false, "also run the dependencies of selected stages")
+	cmd.Flags().StringVar(&stateLocation, "state", "", "record applied stages (file://path, configmap://ns/name or secret://ns/name)")
+	addHelmFlags(cmd)
+}
+
+// addHelmFlags registers the flags needed to connect to tiller
+func addHelmFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&helmConfig, "helm-config", "", "helm config")
+	cmd.Flags().StringVarP(&tillerName, "tillerName", "n", "kube-system", "namespace to search for Tiller")
+	cmd.Flags().StringVarP(&tillerPort, "tillerPort", "p", "44134", "port to connect on Tiller")
+}
+
+// loadWorkflow renders the scroll and resolves the digest of each image,
+// if build is false we only look up what has previously been pushed
+func loadWorkflow(ctx context.Context, spec string, build bool, halt <-chan struct{}) (*schema.Workflow, error) {
+	workflow := schema.NewWorkflow()
+
+	data, err := util.RenderFile(spec, outValues, core.RenderWith(k8s))
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, &workflow); err != nil {
+		return nil, err
+	}
+	workflow.Values.Append(outValues)
+	if err = core.Import(ctx, workflow, spec, core.RenderWith(k8s)); err != nil {
+		return nil, err
+	}
+
+	// do builds and fetch tags
+	shas := make(map[string]string, len(workflow.Build)+len(workflow.Tag))
+	for _, img := range workflow.Build {
+		if halted(halt) {
+			return nil, fmt.Errorf("interrupted")
+		}
+		if !build {
+			log.Infof("Would build: %s", img.Reference)
+			if shas[img.Name], err = docker.GetImageDigest(img.Reference); err != nil {
+				log.Warnf("No existing digest for %s: %v", img.Reference, err)
+			}
+			continue
+		}
+		shas[img.Name], err = docker.BuildAndPush(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, img := range workflow.Tag {
+		shas[img.Name], err = docker.GetImageDigest(img.Reference)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// we want those shas before we
+	// template the main workflow
+	workflow.Values.AppendStr(shas)
+
+	if len(workflow.Stages) == 0 {
+		return nil, fmt.Errorf("nothing to run")
+	}
+	if workflow.Stages, err = core.Expand(workflow.Stages, workflow.Values); err != nil {
+		return nil, err
+	}
+	if workflow.Stages, err = core.Select(workflow.Stages, selection); err != nil {
+		return nil, err
+	}
+	return workflow, nil
+}
+
+// connectWorkflow opens the connection to tiller, then
+// lints and renders every stage in the workflow
+func connectWorkflow(workflow *schema.Workflow) (*helm.Tiller, error) {
+	tiller, err := helm.NewClient(k8s, helmConfig, tillerName, tillerPort)
+	if err != nil {
+		return nil, err
+	}
+
+	// lint first so that defaults cascade into each stage
+	if err = core.Lint(workflow, workflow.Values); err != nil {
+		tiller.Close()
+		return nil, err
+	}
+
+	if err = core.Connect(workflow, k8s, tiller, workflow.Values); err != nil {
+		tiller.Close()
+		return nil, err
+	}
+
+	return tiller, nil
+}
+
+// runOptions combines the workflow settings with those given on the command line
+func runOptions(workflow *schema.Workflow) (core.Options, error) {
+	opts := core.Options{
+		Force:     force,
+		OnFailure: workflow.OnFailure,
+		Parallel:  workflow.Concurrency.Stages,
+		Funcs:     core.RenderWith(k8s),
+	}
+	k8s.Parallel = workflow.Concurrency.Objects
+	if parallel > 0 {
+		opts.Parallel = parallel
+		opts.Overrides.Parallel = parallel
+	}
+	if parallelObjects > 0 {
+		k8s.Parallel = parallelObjects
+	}
+	if onFailure != "" {
+		opts.OnFailure = schema.Policy(onFailure)
+		if err := opts.OnFailure.Validate(); err != nil {
+			return opts, err
+		}
+		opts.Overrides.OnFailure = opts.OnFailure
+	}
+	store, err := openState()
+	if err != nil {
+		return opts, err
+	}
+	opts.Store = store
+	return opts, nil
+}
+
+// openState returns the store given by --state, if any
+func openState() (state.Store, error) {
+	if stateLocation == "" {
+		return nil, nil
+	}
+	return state.Open(stateLocation, k8s)
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/kube"
+	"github.com/monax/compass/util"
+)
+
+// Expand replaces each stage with a foreach by one instance per item, keyed
+// as <stage>-<item>, dependencies on the original stage then mean all instances
+func Expand(stages map[string]*schema.Stage, values util.Values) (map[string]*schema.Stage, error) {
+	expanded := make(map[string]*schema.Stage, len(stages))
+	instances := make(map[string][]string)
+
+	keys := make([]string, 0, len(stages))
+	for key := range stages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		stg := stages[key]
+		if stg.Foreach == nil {
+			expanded[key] = stg
+			continue
+		}
+
+		items, err := foreach(stg.Foreach, values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+
+		instances[key] = make([]string, 0, len(items))
+		for i, item := range items {
+			suffix := itemName(item, i)
+			instance := fmt.Sprintf("%s-%s", key, suffix)
+			if _, ok := expanded[instance]; ok {
+				return nil, fmt.Errorf("%s: instance %s is not unique", key, instance)
+			} else if _, ok := stages[instance]; ok {
+				return nil, fmt.Errorf("%s: instance %s conflicts with a stage of the same name", key, instance)
+			}
+
+			copied := &schema.Stage{Actions: stg.Actions, Resource: clone(stg.Resource)}
+			copied.Foreach = nil
+			copied.Scope = util.Values{"item": item, "index": i}
+
+			// instances would otherwise share a release
+			switch res := copied.Resource.(type) {
+			case *helm.Chart:
+				if res.Release = values.Cascade(res.Release, key, "release"); res.Release != "" {
+					res.Release = fmt.Sprintf("%s-%s", res.Release, suffix)
+				} else {
+					res.Release = instance
+				}
+				res.Namespace = values.Cascade(res.Namespace, key, "namespace")
+			case *kube.Manifest:
+				res.Namespace = values.Cascade(res.Namespace, key, "namespace")
+			}
+
+			expanded[instance] = copied
+			instances[key] = append(instances[key], instance)
+		}
+	}
+
+	if len(instances) == 0 {
+		return stages, nil
+	}
+
+	for _, stg := range expanded {
+		var depends []string
+		for _, dep := range stg.Depends {
+			if keys, ok := instances[dep]; ok {
+				depends = append(depends, keys...)
+			} else {
+				depends = append(depends, dep)
+			}
+		}
+		stg.Depends = depends
+	}
+	return expanded, nil
+}
+
+// foreach returns the items of a list, or of the list found at the given path
+func foreach(from interface{}, values util.Values) ([]interface{}, error) {
+	if path, ok := from.(string); ok {
+		found, ok := values.Lookup(path)
+		if !ok {
+			return nil, fmt.Errorf("foreach value %s not found", path)
+		}
+		from = found
+	}
+
+	list := reflect.ValueOf(from)
+	if list.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("foreach expects a list, got %T", from)
+	}
+	items := make([]interface{}, list.Len())
+	for i := range items {
+		items[i] = list.Index(i).Interface()
+	}
+	return items, nil
+}
+
+// itemName identifies an item by its value, or its name field if it has one
+func itemName(item interface{}, index int) string {
+	switch it := item.(type) {
+	case string, int, int64, float64, bool:
+		return fmt.Sprintf("%v", it)
+	case util.Values:
+		if n, ok := it["name"]; ok {
+			return fmt.Sprintf("%v", n)
+		}
+	case map[interface{}]interface{}:
+		if n, ok := it["name"]; ok {
+			return fmt.Sprintf("%v", n)
+		}
+	case map[string]interface{}:
+		if n, ok := it["name"]; ok {
+			return fmt.Sprintf("%v", n)
+		}
+	}
+	return fmt.Sprintf("%d", index)
+}
+
+// clone returns a shallow copy of the resource so each instance can differ
+func clone(res schema.Resource) schema.Resource {
+	v := reflect.ValueOf(res)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return res
+	}
+	c := reflect.New(v.Elem().Type())
+	c.Elem().Set(v.Elem())
+	return c.Interface().(schema.Resource)
+}
+
+// scope adds the item and index of an expanded stage to the values
+func scope(values util.Values, stg *schema.Stage) util.Values {
+	if len(stg.Scope) == 0 {
+		return values
+	}
+	scoped := make(util.Values, len(values)+len(stg.Scope))
+	for key, value := range values {
+		scoped[key] = value
+	}
+	for key, value := range stg.Scope {
+		scoped[key] = value
+	}
+	return scoped
+}
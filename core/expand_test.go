@@ -0,0 +1,99 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpand(t *testing.T) {
+	stages := newTestResources("db", "api", "web")
+	stages["api"].Foreach = "tenants"
+	stages["api"].Depends = []string{"db"}
+	stages["web"].Depends = []string{"api"}
+	values := util.Values{"tenants": []interface{}{"one", "two"}}
+
+	expanded, err := Expand(stages, values)
+	require.NoError(t, err)
+	require.Len(t, expanded, 4)
+	assert.Equal(t, []string{"db"}, expanded["api-one"].Depends)
+	assert.Equal(t, util.Values{"item": "two", "index": 1}, expanded["api-two"].Scope)
+	assert.Nil(t, expanded["api-two"].Foreach)
+	assert.ElementsMatch(t, []string{"api-one", "api-two"}, expanded["web"].Depends)
+
+	// each instance gets its own resource
+	assert.False(t, expanded["api-one"].Resource == expanded["api-two"].Resource)
+
+	// items are named by their name field, or index
+	stages = newTestResources("api")
+	stages["api"].Foreach = []interface{}{
+		map[interface{}]interface{}{"name": "acme"},
+		map[interface{}]interface{}{"region": "eu"},
+	}
+	expanded, err = Expand(stages, values)
+	require.NoError(t, err)
+	assert.Contains(t, expanded, "api-acme")
+	assert.Contains(t, expanded, "api-1")
+
+	stages["api"].Foreach = "missing"
+	_, err = Expand(stages, values)
+	assert.Error(t, err)
+
+	stages["api"].Foreach = []interface{}{"one", "one"}
+	_, err = Expand(stages, values)
+	assert.Error(t, err)
+
+	stages = newTestResources("api", "api-one")
+	stages["api"].Foreach = []interface{}{"one"}
+	_, err = Expand(stages, values)
+	assert.Error(t, err)
+}
+
+func TestExpandChart(t *testing.T) {
+	stages := map[string]*schema.Stage{
+		"api":    newTestChart(),
+		"worker": newTestChart(),
+	}
+	stages["api"].Foreach = []interface{}{"one", "two"}
+	stages["worker"].Foreach = []interface{}{"one"}
+	stages["worker"].Resource.(*helm.Chart).Release = ""
+	stages["worker"].Resource.(*helm.Chart).Namespace = ""
+	values := util.Values{"worker": util.Values{"namespace": "jobs"}}
+
+	expanded, err := Expand(stages, values)
+	require.NoError(t, err)
+	assert.Equal(t, "test-release-one", expanded["api-one"].Resource.(*helm.Chart).Release)
+	assert.Equal(t, "test-release-two", expanded["api-two"].Resource.(*helm.Chart).Release)
+	assert.Equal(t, "worker-one", expanded["worker-one"].Resource.(*helm.Chart).Release)
+	assert.Equal(t, "jobs", expanded["worker-one"].Resource.(*helm.Chart).Namespace)
+	assert.Equal(t, "test-release", stages["api"].Resource.(*helm.Chart).Release)
+}
+
+func TestForeach(t *testing.T) {
+	template := filepath.Join(t.TempDir(), "api.yaml")
+	require.NoError(t, ioutil.WriteFile(template, []byte("{{ .index }}: {{ .item.name }}"), 0644))
+
+	stages := newTestResources("api")
+	stages["api"].Template = template
+	stages["api"].Render = schema.Lazy
+	stages["api"].Foreach = "tenants"
+	stages["api"].When = `{{ ne .item.name "skip" }}`
+	values := util.Values{"tenants": []interface{}{
+		map[string]interface{}{"name": "acme"},
+		map[string]interface{}{"name": "skip"},
+	}}
+
+	expanded, err := Expand(stages, values)
+	require.NoError(t, err)
+	require.NoError(t, Forward(context.Background(), expanded, values, Options{}))
+	assert.Equal(t, "0: acme", string(expanded["api-acme"].GetInput()))
+	assert.True(t, installed(expanded["api-acme"]))
+	assert.False(t, installed(expanded["api-skip"]))
+}
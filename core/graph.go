@@ -0,0 +1,116 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/kube"
+	"github.com/monax/compass/util"
+)
+
+// Vertex describes a stage in the dependency graph
+type Vertex struct {
+	Stage     string   `json:"stage"`
+	Kind      string   `json:"kind"`
+	Release   string   `json:"release,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	Satisfied bool     `json:"satisfied"`        // requirements are met
+	Reason    string   `json:"reason,omitempty"` // why requirements are not met
+	Depends   []string `json:"depends,omitempty"`
+}
+
+// Graph lists each stage in dependency order along with its requirements
+func Graph(stages map[string]*schema.Stage, input util.Values, funcs template.FuncMap) ([]Vertex, error) {
+	order, err := Order(stages)
+	if err != nil {
+		return nil, err
+	}
+
+	graph := make([]Vertex, 0, len(order))
+	for _, key := range order {
+		stg := stages[key]
+		v := Vertex{Stage: key, Kind: stg.Kind, Depends: stg.Depends, Satisfied: true}
+		switch res := stg.Resource.(type) {
+		case *helm.Chart:
+			v.Release, v.Namespace = res.Release, res.Namespace
+		case *kube.Manifest:
+			v.Namespace = res.Namespace
+		}
+		if err := checkRequires(input, stg.Requires); err != nil {
+			v.Satisfied, v.Reason = false, err.Error()
+		} else if ok, err := checkWhen(scope(input, stg), stg.When, funcs); err != nil {
+			v.Satisfied, v.Reason = false, err.Error()
+		} else if !ok {
+			v.Satisfied, v.Reason = false, "condition not met"
+		}
+		graph = append(graph, v)
+	}
+	return graph, nil
+}
+
+// label summarises the vertex in a single line
+func (v Vertex) label() string {
+	parts := []string{v.Kind}
+	if v.Release != "" {
+		parts = append(parts, v.Release)
+	}
+	if v.Namespace != "" {
+		parts = append(parts, v.Namespace)
+	}
+	label := fmt.Sprintf("%s (%s)", v.Stage, strings.Join(parts, ", "))
+	if !v.Satisfied {
+		label += fmt.Sprintf(" - %s", v.Reason)
+	}
+	return label
+}
+
+// DOT renders the graph for Graphviz, edges point from a stage to its dependencies
+func DOT(graph []Vertex) string {
+	var sb strings.Builder
+	sb.WriteString("digraph compass {\n")
+	sb.WriteString("  rankdir=BT;\n")
+	sb.WriteString("  node [shape=box];\n")
+	for _, v := range graph {
+		style := ""
+		if !v.Satisfied {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(&sb, "  %q [label=%q%s];\n", v.Stage, v.label(), style)
+	}
+	for _, v := range graph {
+		for _, dep := range v.Depends {
+			fmt.Fprintf(&sb, "  %q -> %q;\n", v.Stage, dep)
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// Mermaid renders the graph as a flowchart, edges point from a dependency to its dependants
+func Mermaid(graph []Vertex) string {
+	ids := make(map[string]string, len(graph))
+	for i, v := range graph {
+		ids[v.Stage] = fmt.Sprintf("s%d", i)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("graph TD\n")
+	for _, v := range graph {
+		label := strings.Replace(v.label(), `"`, "#quot;", -1)
+		fmt.Fprintf(&sb, "  %s[\"%s\"]\n", ids[v.Stage], label)
+	}
+	for _, v := range graph {
+		for _, dep := range v.Depends {
+			fmt.Fprintf(&sb, "  %s --> %s\n", ids[dep], ids[v.Stage])
+		}
+	}
+	for _, v := range graph {
+		if !v.Satisfied {
+			fmt.Fprintf(&sb, "  style %s stroke-dasharray: 5 5\n", ids[v.Stage])
+		}
+	}
+	return sb.String()
+}
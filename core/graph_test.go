@@ -0,0 +1,32 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/monax/compass/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraph(t *testing.T) {
+	stages := newTestResources("db", "api")
+	stages["api"].Depends = []string{"db"}
+	stages["api"].Requires = util.Values{"env": "prod"}
+
+	graph, err := Graph(stages, util.Values{}, nil)
+	require.NoError(t, err)
+	require.Len(t, graph, 2)
+	assert.Equal(t, "db", graph[0].Stage)
+	assert.True(t, graph[0].Satisfied)
+	assert.False(t, graph[1].Satisfied)
+	assert.Equal(t, "argument 'env' not given", graph[1].Reason)
+
+	dot := DOT(graph)
+	assert.Contains(t, dot, `"db" [label="db (test)"];`)
+	assert.Contains(t, dot, `"api" -> "db";`)
+
+	mermaid := Mermaid(graph)
+	assert.Contains(t, mermaid, `s0["db (test)"]`)
+	assert.Contains(t, mermaid, "s0 --> s1")
+	assert.Contains(t, mermaid, "style s1 stroke-dasharray: 5 5")
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/util"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Import adds the stages of each scroll imported by the workflow, keyed as
+// <as>.<stage>, and their values beneath those of the workflow, imports are
+// found relative to the directory of the given scroll
+func Import(ctx context.Context, wf *schema.Workflow, scroll string, funcs template.FuncMap) error {
+	return imports(ctx, wf, scroll, funcs, nil)
+}
+
+func imports(ctx context.Context, wf *schema.Workflow, scroll string, funcs template.FuncMap, seen []string) error {
+	if len(wf.Imports) == 0 {
+		return nil
+	}
+
+	abs, err := filepath.Abs(scroll)
+	if err != nil {
+		return err
+	}
+	for _, s := range seen {
+		if s == abs {
+			return fmt.Errorf("import cycle: %s", strings.Join(append(seen, abs), " -> "))
+		}
+	}
+	seen = append(seen, abs)
+
+	values := make(util.Values)
+	for _, imp := range wf.Imports {
+		path, err := locate(ctx, imp, filepath.Dir(scroll))
+		if err != nil {
+			return fmt.Errorf("couldn't import %s: %v", imp.Scroll, err)
+		}
+
+		prefix := imp.As
+		if prefix == "" {
+			prefix = strings.TrimSuffix(filepath.Base(imp.Scroll), filepath.Ext(imp.Scroll))
+		}
+
+		data, err := util.RenderFile(path, wf.Values, funcs)
+		if err != nil {
+			return err
+		}
+		sub := schema.NewWorkflow()
+		if err = yaml.Unmarshal(data, &sub); err != nil {
+			return fmt.Errorf("couldn't import %s: %v", imp.Scroll, err)
+		}
+
+		// the values of the importer take precedence, including in nested imports
+		merged := make(util.Values)
+		merged.Append(sub.Values)
+		merged.Append(wf.Values)
+		sub.Values = merged
+		if err = imports(ctx, sub, path, funcs, seen); err != nil {
+			return err
+		}
+		values.Append(sub.Values)
+
+		for key, stg := range sub.Stages {
+			name := prefix + "." + key
+			if _, ok := wf.Stages[name]; ok {
+				return fmt.Errorf("imported stage %s already exists", name)
+			}
+
+			// dependencies outside of the import are left as they are
+			for i, dep := range stg.Depends {
+				if _, ok := sub.Stages[dep]; ok {
+					stg.Depends[i] = prefix + "." + dep
+				}
+			}
+			if stg.Template != "" && !filepath.IsAbs(stg.Template) {
+				stg.Template = filepath.Join(filepath.Dir(path), stg.Template)
+			}
+			if stg.Render == "" {
+				stg.Render = sub.Render
+			}
+			if stg.OnFailure == "" {
+				stg.OnFailure = sub.OnFailure
+			}
+			wf.Stages[name] = stg
+		}
+	}
+
+	values.Append(wf.Values)
+	wf.Values = values
+	return nil
+}
+
+// Imported returns the keys of the stages which the imports of a
+// rendered scroll add to it, so that its stages may depend on them
+func Imported(ctx context.Context, data []byte, scroll string, values util.Values, funcs template.FuncMap) ([]string, error) {
+	wf := schema.NewWorkflow()
+	if err := yaml.Unmarshal(data, &wf); err != nil {
+		return nil, err
+	}
+	own := make(map[string]bool, len(wf.Stages))
+	for key := range wf.Stages {
+		own[key] = true
+	}
+
+	wf.Values.Append(values)
+	if err := Import(ctx, wf, scroll, funcs); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range wf.Stages {
+		if !own[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// locate returns the path of an imported scroll, cloning its repository if needed
+func locate(ctx context.Context, imp schema.Import, dir string) (string, error) {
+	if imp.Scroll == "" {
+		return "", fmt.Errorf("scroll is required")
+	} else if imp.Git == "" {
+		if filepath.IsAbs(imp.Scroll) {
+			return imp.Scroll, nil
+		}
+		return filepath.Join(dir, imp.Scroll), nil
+	}
+
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(imp.Git + "@" + imp.Ref))
+	repo := filepath.Join(cache, "compass", "imports", hex.EncodeToString(sum[:8]))
+	if err = util.Checkout(ctx, imp.Git, imp.Ref, repo); err != nil {
+		return "", err
+	}
+	return filepath.Join(repo, imp.Scroll), nil
+}
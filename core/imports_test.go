@@ -0,0 +1,172 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func writeScroll(t *testing.T, path, data string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+}
+
+func loadScroll(t *testing.T, path string) *schema.Workflow {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	wf := schema.NewWorkflow()
+	require.NoError(t, yaml.Unmarshal(data, &wf))
+	return wf
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	writeScroll(t, filepath.Join(dir, "scroll.yaml"), `
+imports:
+- scroll: lib/observability.yaml
+values:
+  namespace: product
+stages:
+  api:
+    kind: kube
+    template: api.yaml
+    depends:
+    - observability.prometheus
+`)
+	writeScroll(t, filepath.Join(dir, "lib", "observability.yaml"), `
+imports:
+- scroll: logging.yaml
+  as: logs
+values:
+  namespace: monitoring
+  retention: 7d
+render: lazy
+stages:
+  prometheus:
+    kind: kube
+    template: prometheus.yaml
+    depends:
+    - logs.fluentd
+  grafana:
+    kind: kube
+    template: /abs/grafana.yaml
+    depends:
+    - prometheus
+    - api
+`)
+	writeScroll(t, filepath.Join(dir, "lib", "logging.yaml"), `
+stages:
+  fluentd:
+    kind: kube
+    template: fluentd.yaml
+    onFailure: abort
+`)
+
+	wf := loadScroll(t, filepath.Join(dir, "scroll.yaml"))
+	require.NoError(t, Import(context.Background(), wf, filepath.Join(dir, "scroll.yaml"), nil))
+
+	assert.Len(t, wf.Stages, 4)
+	assert.Equal(t, []string{"observability.logs.fluentd"}, wf.Stages["observability.prometheus"].Depends)
+	assert.Equal(t, []string{"observability.prometheus", "api"}, wf.Stages["observability.grafana"].Depends)
+	assert.Equal(t, filepath.Join(dir, "lib", "prometheus.yaml"), wf.Stages["observability.prometheus"].Template)
+	assert.Equal(t, "/abs/grafana.yaml", wf.Stages["observability.grafana"].Template)
+	assert.Equal(t, "api.yaml", wf.Stages["api"].Template)
+	assert.Equal(t, schema.Lazy, wf.Stages["observability.grafana"].Render)
+	assert.Equal(t, schema.Lazy, wf.Stages["observability.logs.fluentd"].Render)
+	assert.Equal(t, schema.Abort, wf.Stages["observability.logs.fluentd"].OnFailure)
+
+	// the importer takes precedence
+	assert.Equal(t, "product", wf.Values["namespace"])
+	assert.Equal(t, "7d", wf.Values["retention"])
+	require.NoError(t, Validate(wf.Stages))
+
+	writeScroll(t, filepath.Join(dir, "lib", "logging.yaml"), `
+imports:
+- scroll: ../scroll.yaml
+`)
+	wf = loadScroll(t, filepath.Join(dir, "scroll.yaml"))
+	err := Import(context.Background(), wf, filepath.Join(dir, "scroll.yaml"), nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "import cycle")
+}
+
+func TestImported(t *testing.T) {
+	dir := t.TempDir()
+	writeScroll(t, filepath.Join(dir, "api.yaml"), "kind: ConfigMap\n")
+	writeScroll(t, filepath.Join(dir, "scroll.yaml"), `
+imports:
+- scroll: observability.yaml
+  as: obs
+stages:
+  api:
+    kind: kube
+    template: `+filepath.Join(dir, "api.yaml")+`
+    depends:
+    - obs.prom
+`)
+	writeScroll(t, filepath.Join(dir, "observability.yaml"), `
+stages:
+  prom:
+    kind: kube
+    template: prometheus.yaml
+`)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "scroll.yaml"))
+	require.NoError(t, err)
+	imported, err := Imported(context.Background(), data, filepath.Join(dir, "scroll.yaml"), nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"obs.prom"}, imported)
+
+	problems, err := schema.Check(data, imported...)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	problems, err = schema.Check(data)
+	require.NoError(t, err)
+	require.Len(t, problems, 1)
+	assert.Equal(t, "stage obs.prom does not exist", problems[0].Message)
+}
+
+func TestImportGit(t *testing.T) {
+	remote := t.TempDir()
+	writeScroll(t, filepath.Join(remote, "observability", "scroll.yaml"), `
+stages:
+  prometheus:
+    kind: kube
+    template: prometheus.yaml
+`)
+	repo, err := git.PlainInit(remote, false)
+	require.NoError(t, err)
+	tree, err := repo.Worktree()
+	require.NoError(t, err)
+	_, err = tree.Add("observability/scroll.yaml")
+	require.NoError(t, err)
+	hash, err := tree.Commit("observability", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	require.NoError(t, err)
+	_, err = repo.CreateTag("v1", hash, nil)
+	require.NoError(t, err)
+
+	cache := os.Getenv("XDG_CACHE_HOME")
+	defer os.Setenv("XDG_CACHE_HOME", cache)
+	os.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	wf := schema.NewWorkflow()
+	wf.Imports = []schema.Import{{Git: remote, Ref: "v1", Scroll: "observability/scroll.yaml", As: "obs"}}
+	require.NoError(t, Import(context.Background(), wf, "scroll.yaml", nil))
+	require.Contains(t, wf.Stages, "obs.prometheus")
+	assert.FileExists(t, filepath.Join(filepath.Dir(wf.Stages["obs.prometheus"].Template), "scroll.yaml"))
+
+	wf.Imports[0].Ref = "v2"
+	assert.Error(t, Import(context.Background(), wf, "scroll.yaml", nil))
+}
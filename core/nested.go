@@ -0,0 +1,227 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/kube"
+	"github.com/monax/compass/util"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func init() {
+	schema.Register("workflow", schema.Kind{
+		New:      func() schema.Resource { return new(Nested) },
+		Required: map[string]string{"scroll": "scroll"},
+	})
+}
+
+// clients are shared by the stages of a nested workflow
+type clients struct {
+	k8s    *kube.K8s
+	tiller *helm.Tiller
+}
+
+// Nested is a stage which runs the stages of another scroll
+type Nested struct {
+	Scroll string      `yaml:"scroll"` // path to the scroll
+	Values util.Values `yaml:"values"` // layered over the values of the parent
+	Source []byte      `yaml:"-"`      // the scroll, so changes are fingerprinted
+	Object []byte      `yaml:"-"`      // rendered template, also layered over the values
+	clients
+
+	mu       sync.Mutex
+	parent   util.Values
+	workflow *schema.Workflow
+	run      Options // of the parent, set by its executor
+}
+
+// Lint checks that our definition has a scroll and keeps the parent values
+func (n *Nested) Lint(key string, in *util.Values) (err error) {
+	if n.Scroll == "" {
+		return fmt.Errorf("scroll for %s is empty", key)
+	}
+	if n.Source, err = ioutil.ReadFile(n.Scroll); err != nil {
+		return fmt.Errorf("scroll for %s: %v", key, err)
+	}
+	n.parent = *in
+	return nil
+}
+
+// Connect keeps the clients for the nested stages
+func (n *Nested) Connect(bridge interface{}) {
+	n.clients = bridge.(clients)
+}
+
+// SetInput adds the templated values
+func (n *Nested) SetInput(obj []byte) {
+	n.Object = obj
+}
+
+// GetInput gets the templated values
+func (n *Nested) GetInput() []byte {
+	return n.Object
+}
+
+// load renders the scroll once, layering the values of the parent, the stage
+// and its template over those of the scroll, then lints and connects it
+func (n *Nested) load(ctx context.Context) (*schema.Workflow, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.workflow != nil {
+		return n.workflow, nil
+	}
+
+	values := make(util.Values)
+	values.Append(n.parent)
+	values.Append(n.Values)
+	if err := values.FromBytes(n.Object); err != nil {
+		return nil, err
+	}
+
+	funcs := RenderWith(n.k8s)
+	data, err := util.RenderFile(n.Scroll, values, funcs)
+	if err != nil {
+		return nil, err
+	}
+	wf := schema.NewWorkflow()
+	if err = yaml.Unmarshal(data, &wf); err != nil {
+		return nil, err
+	} else if len(wf.Build) > 0 || len(wf.Tag) > 0 {
+		return nil, fmt.Errorf("%s: images are only built or tagged by the top level scroll", n.Scroll)
+	}
+	wf.Values.Append(values)
+
+	if err = Import(ctx, wf, n.Scroll, funcs); err != nil {
+		return nil, err
+	} else if wf.Stages, err = Expand(wf.Stages, wf.Values); err != nil {
+		return nil, err
+	} else if err = Lint(wf, wf.Values); err != nil {
+		return nil, err
+	} else if err = Connect(wf, n.k8s, n.tiller, wf.Values); err != nil {
+		return nil, err
+	}
+	n.workflow = wf
+	return wf, nil
+}
+
+// inherit keeps the options of the parent run, the nested stages
+// are recorded by the given tracker
+func (n *Nested) inherit(opts Options, t *tracker) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.run = opts
+	n.run.tracker = t
+}
+
+// options runs the nested stages with the options of the parent, the
+// settings of the scroll taking precedence unless overridden
+func (n *Nested) options(wf *schema.Workflow) Options {
+	n.mu.Lock()
+	opts := n.run
+	n.mu.Unlock()
+
+	opts.DryRun = opts.DryRun || (n.k8s != nil && n.k8s.DryRun)
+	opts.Funcs = RenderWith(n.k8s)
+	if wf.OnFailure != "" {
+		opts.OnFailure = wf.OnFailure
+	}
+	if wf.Concurrency.Stages > 0 {
+		opts.Parallel = wf.Concurrency.Stages
+	}
+	if opts.Overrides.OnFailure != "" {
+		opts.OnFailure = opts.Overrides.OnFailure
+	}
+	if opts.Overrides.Parallel > 0 {
+		opts.Parallel = opts.Overrides.Parallel
+	}
+	if opts.tracker == nil {
+		// not run by an executor, which would otherwise start a new run
+		opts.Store = nil
+		opts.Resume = false
+	}
+	return opts
+}
+
+// Status returns true only if every nested stage is installed
+func (n *Nested) Status(ctx context.Context) (bool, error) {
+	wf, err := n.load(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, stg := range wf.Stages {
+		if installed, err := stg.Status(ctx); err != nil || !installed {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// InstallOrUpgrade runs the nested stages in order
+func (n *Nested) InstallOrUpgrade(ctx context.Context) error {
+	wf, err := n.load(ctx)
+	if err != nil {
+		return err
+	}
+	return Forward(ctx, wf.Stages, wf.Values, n.options(wf))
+}
+
+// Delete removes the nested stages in reverse order
+func (n *Nested) Delete(ctx context.Context) error {
+	wf, err := n.load(ctx)
+	if err != nil {
+		return err
+	}
+	return Backward(ctx, wf.Stages, wf.Values, n.options(wf))
+}
+
+// Rollback reverts each nested stage, dependants first
+func (n *Nested) Rollback(ctx context.Context) error {
+	wf, err := n.load(ctx)
+	if err != nil {
+		return err
+	}
+	order, err := Order(wf.Stages)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for i := len(order) - 1; i >= 0; i-- {
+		if err := wf.Stages[order[i]].Rollback(ctx); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", order[i], err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("couldn't roll back %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Diff compares each nested stage with what is live
+func (n *Nested) Diff(ctx context.Context) (string, error) {
+	wf, err := n.load(ctx)
+	if err != nil {
+		return "", err
+	}
+	order, err := Order(wf.Stages)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, key := range order {
+		diff, err := wf.Stages[key].Diff(ctx)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", key, err)
+		} else if diff != "" {
+			fmt.Fprintf(&sb, "# %s\n%s", key, diff)
+		}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/kube"
+	"github.com/monax/compass/state"
+	"github.com/monax/compass/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestNested(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"first", "second", "apps"} {
+		writeScroll(t, filepath.Join(dir, name+".yaml"), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: `+name+`
+data:
+  tier: {{ .tier }}
+`)
+	}
+	writeScroll(t, filepath.Join(dir, "base.yaml"), `
+values:
+  tier: base
+  namespace: default
+stages:
+  first:
+    kind: kube
+    template: `+filepath.Join(dir, "first.yaml")+`
+  second:
+    kind: kube
+    template: `+filepath.Join(dir, "second.yaml")+`
+    depends:
+    - first
+`)
+	writeScroll(t, filepath.Join(dir, "scroll.yaml"), `
+stages:
+  base:
+    kind: workflow
+    scroll: `+filepath.Join(dir, "base.yaml")+`
+    values:
+      tier: shared
+  apps:
+    kind: kube
+    namespace: default
+    template: `+filepath.Join(dir, "apps.yaml")+`
+    depends:
+    - base
+`)
+
+	wf := loadScroll(t, filepath.Join(dir, "scroll.yaml"))
+	require.IsType(t, &Nested{}, wf.Stages["base"].Resource)
+
+	k8s := kube.NewFakeClient()
+	require.NoError(t, Lint(wf, wf.Values))
+	require.NoError(t, Connect(wf, k8s, nil, wf.Values))
+
+	installed, err := wf.Stages["base"].Status(context.Background())
+	require.NoError(t, err)
+	assert.False(t, installed)
+
+	store := &state.File{Path: filepath.Join(dir, "state.json")}
+	require.NoError(t, Forward(context.Background(), wf.Stages, wf.Values, Options{Store: store}))
+	installed, err = wf.Stages["base"].Status(context.Background())
+	require.NoError(t, err)
+	assert.True(t, installed)
+
+	// nested stages are recorded in the same run beneath their parent
+	st, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 1, st.Run)
+	for _, key := range []string{"base", "base/first", "base/second", "apps"} {
+		require.Contains(t, st.Stages, key)
+		assert.Equal(t, string(Succeeded), st.Stages[key].Outcome)
+	}
+
+	// the values of the stage are layered over those of the scroll
+	nested := wf.Stages["base"].Resource.(*Nested).workflow
+	assert.Contains(t, string(nested.Stages["second"].GetInput()), "tier: shared")
+
+	require.NoError(t, Backward(context.Background(), wf.Stages, wf.Values, Options{Store: store}))
+	installed, err = wf.Stages["base"].Status(context.Background())
+	require.NoError(t, err)
+	assert.False(t, installed)
+
+	st, err = store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, st.Stages)
+}
+
+func TestNestedOptions(t *testing.T) {
+	halt := make(chan struct{})
+	n := &Nested{}
+	wf := schema.NewWorkflow()
+	wf.OnFailure = schema.Rollback
+	wf.Concurrency.Stages = 2
+
+	// without a parent run nothing is recorded
+	opts := n.options(wf)
+	assert.Nil(t, opts.Store)
+	assert.Equal(t, schema.Rollback, opts.OnFailure)
+	assert.Equal(t, 2, opts.Parallel)
+
+	parent := Options{
+		Force:     true,
+		Halt:      halt,
+		Store:     &state.File{},
+		OnFailure: schema.Abort,
+		Parallel:  4,
+	}
+	tracker := &tracker{prefix: "base/"}
+	n.inherit(parent, tracker)
+	opts = n.options(wf)
+	assert.True(t, opts.Force)
+	assert.Equal(t, parent.Store, opts.Store)
+	assert.Equal(t, tracker, opts.tracker)
+	assert.Equal(t, schema.Rollback, opts.OnFailure)
+	assert.Equal(t, 2, opts.Parallel)
+
+	close(halt)
+	assert.Error(t, opts.halted(context.Background()))
+
+	// the command line takes precedence over the scroll
+	parent.Overrides = Overrides{OnFailure: schema.Abort, Parallel: 4}
+	n.inherit(parent, tracker)
+	opts = n.options(wf)
+	assert.Equal(t, schema.Abort, opts.OnFailure)
+	assert.Equal(t, 4, opts.Parallel)
+}
+
+func TestNestedLint(t *testing.T) {
+	var stg schema.Stage
+	require.NoError(t, yaml.Unmarshal([]byte("kind: workflow"), &stg))
+	assert.Error(t, stg.Lint("base", &util.Values{}))
+
+	stg.Resource.(*Nested).Scroll = "missing.yaml"
+	assert.Error(t, stg.Lint("base", &util.Values{}))
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/kube"
+	"github.com/monax/compass/util"
+)
+
+// Deferred returns the stages which are rendered once their dependencies
+// have been applied, those which are lazy or come after a stage with outputs
+func Deferred(stages map[string]*schema.Stage) map[string]bool {
+	// memoise whether each stage, or anything before it, has outputs
+	upstream := make(map[string]bool, len(stages))
+	seen := make(map[string]bool, len(stages))
+
+	var visit func(key string) bool
+	visit = func(key string) bool {
+		if seen[key] {
+			return upstream[key]
+		}
+		seen[key] = true
+		upstream[key] = len(stages[key].Outputs) > 0
+		for _, dep := range stages[key].Depends {
+			if _, ok := stages[dep]; ok && visit(dep) {
+				upstream[key] = true
+			}
+		}
+		return upstream[key]
+	}
+
+	deferred := make(map[string]bool, len(stages))
+	for key, stg := range stages {
+		after := false
+		for _, dep := range stg.Depends {
+			if _, ok := stages[dep]; ok && visit(dep) {
+				after = true
+			}
+		}
+		if after || stg.Render == schema.Lazy {
+			deferred[key] = true
+		}
+	}
+	return deferred
+}
+
+// outputs collects the values captured from each applied stage
+type outputs struct {
+	mu     sync.Mutex
+	values map[string]map[string]string
+}
+
+// add records the outputs of a stage
+func (o *outputs) add(key string, values map[string]string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.values == nil {
+		o.values = make(map[string]map[string]string)
+	}
+	o.values[key] = values
+}
+
+// merge returns a copy of the input with the outputs of
+// each stage added under <stage>.outputs.<name>
+func (o *outputs) merge(input util.Values) util.Values {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.values) == 0 {
+		return input
+	}
+
+	values := make(util.Values, len(input)+len(o.values))
+	for key, value := range input {
+		values[key] = value
+	}
+	for key, outs := range o.values {
+		stage := make(util.Values)
+		switch existing := values[key].(type) {
+		case util.Values:
+			for k, v := range existing {
+				stage[k] = v
+			}
+		case map[string]interface{}:
+			for k, v := range existing {
+				stage[k] = v
+			}
+		}
+		stage["outputs"] = outs
+		values[key] = stage
+	}
+	return values
+}
+
+// capture reads each output declared by the stage, if the jobs did not
+// run this time their output is taken from the saved values instead
+func capture(ctx context.Context, stg *schema.Stage, stdout []string, saved map[string]string, dryRun bool) (map[string]string, error) {
+	values := make(map[string]string, len(stg.Outputs))
+	for name, out := range stg.Outputs {
+		if dryRun {
+			values[name] = ""
+			continue
+		}
+
+		var err error
+		switch {
+		case out.Job != nil:
+			if *out.Job < len(stdout) {
+				values[name] = stdout[*out.Job]
+			} else if value, ok := saved[name]; ok {
+				values[name] = value
+			} else {
+				return nil, fmt.Errorf("output %s: job %d did not run", name, *out.Job)
+			}
+		case out.Object != "":
+			man, ok := stg.Resource.(*kube.Manifest)
+			if !ok {
+				return nil, fmt.Errorf("output %s: object is only supported by kube stages", name)
+			}
+			values[name], err = man.Lookup(ctx, out.Object, out.Path)
+		case out.Release != "":
+			chart, ok := stg.Resource.(*helm.Chart)
+			if !ok {
+				return nil, fmt.Errorf("output %s: release is only supported by helm stages", name)
+			}
+			values[name], err = chart.Lookup(ctx, out.Release, out.Path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %v", name, err)
+		}
+	}
+	return values, nil
+}
+
+// jobOutputs returns the captured values which came from jobs, as
+// these can't be read again without running the jobs
+func jobOutputs(stg *schema.Stage, values map[string]string) map[string]string {
+	saved := make(map[string]string)
+	for name, out := range stg.Outputs {
+		if value, ok := values[name]; ok && out.Job != nil {
+			saved[name] = value
+		}
+	}
+	if len(saved) == 0 {
+		return nil
+	}
+	return saved
+}
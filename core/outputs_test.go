@@ -0,0 +1,110 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/state"
+	"github.com/monax/compass/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeferred(t *testing.T) {
+	stages := newTestResources("db", "api", "web", "docs")
+	stages["db"].Outputs = map[string]schema.Output{"ip": {}}
+	stages["api"].Depends = []string{"db"}
+	stages["web"].Depends = []string{"api"}
+
+	assert.Equal(t, map[string]bool{"api": true, "web": true}, Deferred(stages))
+}
+
+func TestOutputs(t *testing.T) {
+	values := util.Values{"db": util.Values{"release": "database"}}
+	template := filepath.Join(t.TempDir(), "api.yaml")
+	require.NoError(t, ioutil.WriteFile(template, []byte("ip: {{ .db.outputs.ip }}, release: {{ .db.release }}"), 0644))
+
+	job := 0
+	stages := newTestResources("db", "api")
+	stages["db"].Jobs.After = []string{"echo 10.0.0.1"}
+	stages["db"].Outputs = map[string]schema.Output{"ip": {Job: &job}}
+	stages["api"].Depends = []string{"db"}
+	stages["api"].Template = template
+
+	store := &state.File{Path: filepath.Join(t.TempDir(), "state.json")}
+	require.NoError(t, Forward(context.Background(), stages, values, Options{Store: store}))
+	assert.Equal(t, "ip: 10.0.0.1, release: database", string(stages["api"].GetInput()))
+	assert.Equal(t, util.Values{"release": "database"}, values["db"], "input should not change")
+
+	// outputs of jobs are saved so that unchanged stages can provide them
+	st, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"ip": "10.0.0.1"}, st.Stages["db"].Outputs)
+
+	stages["api"].SetInput(nil)
+	require.NoError(t, Forward(context.Background(), stages, values, Options{Store: store}))
+	assert.Equal(t, 1, stages["db"].Resource.(*testResource).applied)
+	assert.Equal(t, "ip: 10.0.0.1, release: database", string(stages["api"].GetInput()))
+}
+
+func TestOutputValidate(t *testing.T) {
+	job := 1
+	assert.NoError(t, schema.Output{Object: "Service/api", Path: "spec.clusterIP"}.Validate("kube", 0))
+	assert.NoError(t, schema.Output{Release: "notes"}.Validate("helm", 0))
+	assert.Error(t, schema.Output{Release: "notes"}.Validate("kube", 0))
+	assert.Error(t, schema.Output{Object: "api", Path: "spec"}.Validate("kube", 0))
+	assert.Error(t, schema.Output{Job: &job}.Validate("helm", 1))
+	assert.Error(t, schema.Output{}.Validate("helm", 0))
+}
+
+func TestLazy(t *testing.T) {
+	stages := newTestResources("db", "api", "web")
+	stages["api"].Depends = []string{"db"}
+	stages["web"].Render = schema.Lazy
+	assert.Equal(t, map[string]bool{"web": true}, Deferred(stages))
+
+	// the workflow default applies to stages without their own
+	wf := schema.NewWorkflow()
+	wf.Stages = stages
+	wf.Render = schema.Lazy
+	stages["db"].Render = schema.Eager
+	require.NoError(t, Lint(wf, util.Values{}))
+	assert.Equal(t, map[string]bool{"api": true, "web": true}, Deferred(stages))
+
+	// rendered once db has been applied
+	template := filepath.Join(t.TempDir(), "api.yaml")
+	require.NoError(t, ioutil.WriteFile(template, []byte("{{ readFile .marker }}"), 0644))
+	marker := filepath.Join(t.TempDir(), "marker")
+	stages["api"].Template = template
+	stages["db"].Jobs.After = []string{"touch " + marker}
+
+	values := util.Values{"marker": marker}
+	require.NoError(t, Forward(context.Background(), stages, values, Options{Funcs: RenderWith(nil)}))
+	assert.Equal(t, "", string(stages["api"].GetInput()))
+
+	wf.Render = "later"
+	assert.Error(t, Lint(wf, util.Values{}))
+}
+
+func TestDeferredFailure(t *testing.T) {
+	template := filepath.Join(t.TempDir(), "api.yaml")
+	require.NoError(t, ioutil.WriteFile(template, []byte("{{ .db.outputs.ip }"), 0644))
+	stages := newTestResources("db", "api")
+	stages["api"].Render = schema.Lazy
+	stages["api"].Template = template
+
+	// a stage which can't be rendered fails like any other
+	store := &state.File{Path: filepath.Join(t.TempDir(), "state.json")}
+	err := Forward(context.Background(), stages, util.Values{}, Options{Store: store, OnFailure: schema.Rollback})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "(rolled back)")
+	assert.True(t, stages["api"].Resource.(*testResource).rolledBack)
+	assert.False(t, installed(stages["api"]))
+
+	st, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, string(Failed), st.Stages["api"].Outcome)
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/util"
+)
+
+// Action is what a run would do to a stage
+type Action string
+
+const (
+	Install Action = "install"
+	Upgrade Action = "upgrade"
+	Delete  Action = "delete"
+	Skip    Action = "skip"
+)
+
+// Step describes the action for a single stage
+type Step struct {
+	Stage   string   `json:"stage"`
+	Kind    string   `json:"kind"`
+	Action  Action   `json:"action"`
+	Reason  string   `json:"reason,omitempty"`
+	Depends []string `json:"depends,omitempty"`
+}
+
+// Order sorts the stages so that each comes after its dependencies,
+// ties are broken alphabetically so the result is stable
+func Order(stages map[string]*schema.Stage) ([]string, error) {
+	if err := Validate(stages); err != nil {
+		return nil, err
+	}
+
+	remaining := make(map[string]int, len(stages))
+	dependants := make(map[string][]string, len(stages))
+	for key, stg := range stages {
+		remaining[key] = len(stg.Depends)
+		for _, dep := range stg.Depends {
+			dependants[dep] = append(dependants[dep], key)
+		}
+	}
+
+	ready := make([]string, 0)
+	for key, count := range remaining {
+		if count == 0 {
+			ready = append(ready, key)
+		}
+	}
+
+	order := make([]string, 0, len(stages))
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		key := ready[0]
+		ready = ready[1:]
+		order = append(order, key)
+		for _, next := range dependants[key] {
+			if remaining[next]--; remaining[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+
+	if len(order) != len(stages) {
+		return nil, fmt.Errorf("cycle in dependencies")
+	}
+	return order, nil
+}
+
+// Plan works out what a run would do to each stage without changing anything
+func Plan(ctx context.Context, stages map[string]*schema.Stage, input util.Values, opts Options, destroy bool) ([]Step, error) {
+	order, err := Order(stages)
+	if err != nil {
+		return nil, err
+	}
+
+	tracker, err := newTracker(opts, false)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make([]Step, 0, len(order))
+	for _, key := range order {
+		stg := stages[key]
+		step := Step{Stage: key, Kind: stg.Kind, Depends: stg.Depends}
+
+		if destroy {
+			step.Action = Delete
+			if step.Reason, err = spare(stg, scope(input, stg), opts); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			} else if step.Reason != "" {
+				step.Action = Skip
+			}
+			steps = append(steps, step)
+			continue
+		}
+
+		installed, _ := stg.Status(ctx)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		tracker.hash(ctx, key, stg)
+
+		step.Action = Install
+		if installed {
+			step.Action = Upgrade
+		}
+		if step.Reason, err = ignore(stg, installed, scope(input, stg), opts); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		} else if step.Reason != "" {
+			step.Action = Skip
+		} else if rec := tracker.unchanged(key); rec != nil && installed && !opts.Force {
+			step.Action = Skip
+			step.Reason = fmt.Sprintf("unchanged since %s", rec.Applied.Format(time.RFC3339))
+		}
+		steps = append(steps, step)
+	}
+
+	if destroy {
+		// dependants are deleted first
+		for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+			steps[i], steps[j] = steps[j], steps[i]
+		}
+	}
+	return steps, nil
+}
+
+// Summary renders a plan as human readable text
+func Summary(steps []Step) string {
+	counts := make(map[Action]int)
+	width := 0
+	for _, step := range steps {
+		counts[step.Action]++
+		if len(step.Stage) > width {
+			width = len(step.Stage)
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Plan: %d to install, %d to upgrade, %d to delete, %d to skip\n",
+		counts[Install], counts[Upgrade], counts[Delete], counts[Skip])
+
+	symbols := map[Action]string{Install: "+", Upgrade: "~", Delete: "-", Skip: " "}
+	for _, step := range steps {
+		fmt.Fprintf(&sb, "  %s %-*s  %-4s  %s", symbols[step.Action], width, step.Stage, step.Kind, step.Action)
+		if step.Reason != "" {
+			fmt.Fprintf(&sb, ": %s", step.Reason)
+		}
+		if len(step.Depends) > 0 {
+			fmt.Fprintf(&sb, " (after %s)", strings.Join(step.Depends, ", "))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/monax/compass/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrder(t *testing.T) {
+	stages := newTestResources("a", "b", "c", "d")
+	stages["a"].Depends = []string{"c"}
+	stages["b"].Depends = []string{"a", "d"}
+
+	order, err := Order(stages)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "a", "d", "b"}, order)
+
+	stages["c"].Depends = []string{"b"}
+	_, err = Order(stages)
+	assert.Error(t, err)
+}
+
+func TestPlan(t *testing.T) {
+	stages := newTestResources("db", "api", "monitoring")
+	stages["api"].Depends = []string{"db"}
+	stages["db"].Resource.(*testResource).installed = true
+	stages["monitoring"].Requires = util.Values{"monitor": "true"}
+	values := make(util.Values)
+
+	steps, err := Plan(context.Background(), stages, values, Options{}, false)
+	require.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Stage: "db", Kind: "test", Action: Upgrade},
+		{Stage: "api", Kind: "test", Action: Install, Depends: []string{"db"}},
+		{Stage: "monitoring", Kind: "test", Action: Skip, Reason: "argument 'monitor' not given"},
+	}, steps)
+
+	// nothing should have been touched
+	assert.False(t, installed(stages["api"]))
+
+	stages["db"].Forget = true
+	steps, err = Plan(context.Background(), stages, values, Options{}, true)
+	require.NoError(t, err)
+	assert.Equal(t, "monitoring", steps[0].Stage)
+	assert.Equal(t, Delete, steps[1].Action)
+	assert.Equal(t, Step{Stage: "db", Kind: "test", Action: Skip, Reason: "forgotten"}, steps[2])
+
+	out, err := json.Marshal(steps[1])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"stage":"api","kind":"test","action":"delete","depends":["db"]}`, string(out))
+
+	assert.Contains(t, Summary(steps), "Plan: 0 to install, 0 to upgrade, 1 to delete, 2 to skip")
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Outcome describes what happened to a stage
+type Outcome string
+
+const (
+	Succeeded Outcome = "succeeded" // installed, upgraded or deleted
+	Ignored   Outcome = "ignored"   // requirements not met or forgotten
+	Unchanged Outcome = "unchanged" // already applied with the same input
+	Failed    Outcome = "failed"    // resource returned an error
+	Skipped   Outcome = "skipped"   // an upstream stage did not succeed
+	Reverted  Outcome = "reverted"  // rolled back to an earlier revision
+)
+
+// Result records the outcome of a single stage
+type Result struct {
+	Outcome Outcome
+	Err     error
+}
+
+// Report collects the results of each stage in a workflow
+type Report struct {
+	mu      sync.Mutex
+	results map[string]*Result
+}
+
+// NewReport returns an empty report
+func NewReport() *Report {
+	return &Report{results: make(map[string]*Result)}
+}
+
+// Add records the outcome of the given stage
+func (r *Report) Add(key string, out Outcome, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results[key] = &Result{Outcome: out, Err: err}
+}
+
+// Skip records that a stage was not run because of the named stages
+func (r *Report) Skip(key string, blocked []string) {
+	r.Add(key, Skipped, fmt.Errorf("blocked by %s", strings.Join(blocked, ", ")))
+}
+
+// Get returns the result for a stage, if any
+func (r *Report) Get(key string) (*Result, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res, ok := r.results[key]
+	return res, ok
+}
+
+// Count returns the number of stages with the given outcome
+func (r *Report) Count(out Outcome) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for _, res := range r.results {
+		if res.Outcome == out {
+			count++
+		}
+	}
+	return count
+}
+
+// String summarises the outcome of every stage
+func (r *Report) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]string, 0, len(r.results))
+	width := 0
+	for key := range r.results {
+		keys = append(keys, key)
+		if len(key) > width {
+			width = len(key)
+		}
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, key := range keys {
+		res := r.results[key]
+		fmt.Fprintf(&sb, "  %-*s  %s", width, key, res.Outcome)
+		if res.Err != nil {
+			fmt.Fprintf(&sb, ": %v", res.Err)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// Err returns an aggregated error if any stage failed or was skipped
+func (r *Report) Err() error {
+	failed, skipped := r.Count(Failed), r.Count(Skipped)
+	if failed == 0 && skipped == 0 {
+		return nil
+	}
+	return fmt.Errorf("workflow incomplete: %d failed, %d skipped\n%s", failed, skipped, r)
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/kube"
+	"github.com/monax/compass/state"
+)
+
+// Revision describes an earlier release of a stage, helm stages are numbered by
+// the revisions of their release and kube stages by the run which applied them
+type Revision struct {
+	Revision    int       `json:"revision"`
+	Updated     time.Time `json:"updated"`
+	Status      string    `json:"status"`
+	Version     string    `json:"version,omitempty"` // chart version
+	Description string    `json:"description,omitempty"`
+}
+
+// History lists the revisions of a stage, oldest first, from its release or the state
+func History(ctx context.Context, key string, stg *schema.Stage, st *state.State) ([]Revision, error) {
+	switch res := stg.Resource.(type) {
+	case *helm.Chart:
+		releases, err := res.History(ctx)
+		if err != nil {
+			return nil, err
+		}
+		revisions := make([]Revision, len(releases))
+		for i, rel := range releases {
+			revisions[i] = Revision{
+				Revision:    int(rel.Version),
+				Updated:     rel.Updated,
+				Status:      rel.Status,
+				Version:     rel.Chart,
+				Description: rel.Description,
+			}
+		}
+		return revisions, nil
+	case *kube.Manifest:
+		rec, err := lastRecord(key, st)
+		if err != nil {
+			return nil, err
+		}
+		records := append(append([]*state.Record(nil), rec.History...), rec)
+		revisions := make([]Revision, len(records))
+		for i, r := range records {
+			revisions[i] = Revision{
+				Revision:    r.Run,
+				Updated:     r.Applied,
+				Status:      r.Outcome,
+				Description: strings.Join(r.Resources, ", "),
+			}
+		}
+		return revisions, nil
+	}
+	return nil, fmt.Errorf("%s stages have no history", stg.Kind)
+}
+
+// Revert rolls a stage back to the given revision or, if zero, to the one before it
+// was last applied, helm stages use their release history whereas kube stages apply
+// the manifest recorded in the state, the record of the stage then notes the revert
+// so that the next run applies it again
+func Revert(ctx context.Context, key string, stg *schema.Stage, store state.Store, revision int) error {
+	st := state.New()
+	if store != nil {
+		var err error
+		if st, err = store.Load(); err != nil {
+			return fmt.Errorf("couldn't load state: %v", err)
+		}
+	}
+	last := st.Stages[key]
+
+	var reverted *state.Record
+	switch res := stg.Resource.(type) {
+	case *helm.Chart:
+		if err := res.RollbackTo(ctx, int32(revision)); err != nil {
+			return err
+		} else if last == nil {
+			return nil
+		}
+		reverted = &state.Record{Run: last.Run, Resources: last.Resources}
+	case *kube.Manifest:
+		rec, err := lastRecord(key, st)
+		if err != nil {
+			return err
+		}
+		target, err := snapshot(rec, revision)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		res.SetInput([]byte(target.Snapshot))
+		if err = res.InstallOrUpgrade(ctx); err != nil {
+			return err
+		}
+		reverted = &state.Record{Run: target.Run, Resources: target.Resources, Snapshot: target.Snapshot}
+	default:
+		return fmt.Errorf("%s stages can't be rolled back", stg.Kind)
+	}
+
+	reverted.Outcome = string(Reverted)
+	reverted.Applied = time.Now().UTC()
+	reverted.History = history(last)
+	st.Stages[key] = reverted
+	if err := store.Save(st); err != nil {
+		return fmt.Errorf("couldn't save state: %v", err)
+	}
+	return nil
+}
+
+// lastRecord returns the record of a stage, which kube stages need to roll back
+func lastRecord(key string, st *state.State) (*state.Record, error) {
+	if rec, ok := st.Stages[key]; ok {
+		return rec, nil
+	}
+	return nil, fmt.Errorf("no record of %s, kube stages need a state store (--state)", key)
+}
+
+// snapshot finds the record of the given run or, if zero,
+// the latest successful record before the last run
+func snapshot(rec *state.Record, run int) (*state.Record, error) {
+	var target *state.Record
+	for _, r := range rec.History {
+		if run != 0 && r.Run == run {
+			target = r
+		} else if run == 0 && r.Run < rec.Run && (target == nil || r.Run > target.Run) {
+			target = r
+		}
+	}
+	if target == nil && run != 0 {
+		return nil, fmt.Errorf("no successful record of run %d", run)
+	} else if target == nil {
+		return nil, fmt.Errorf("no earlier run to roll back to")
+	} else if target.Snapshot == "" && secrets(target.Resources) {
+		return nil, fmt.Errorf("no snapshot of run %d, manifests with secrets are only kept in a secret:// or file:// state", target.Run)
+	} else if target.Snapshot == "" {
+		// recorded before snapshots were kept
+		return nil, fmt.Errorf("no snapshot of run %d", target.Run)
+	}
+	return target, nil
+}
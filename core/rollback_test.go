@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/kube"
+	"github.com/monax/compass/state"
+	"github.com/monax/compass/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevert(t *testing.T) {
+	ctx := context.Background()
+	store := &state.File{Path: filepath.Join(t.TempDir(), "state.json")}
+	stages := map[string]*schema.Stage{"config": newTestManifest()}
+	opts := Options{Store: store}
+	data := func() string {
+		out, err := stages["config"].Resource.(*kube.Manifest).Lookup(ctx, "ConfigMap/config-data", "data.test")
+		require.NoError(t, err)
+		return out
+	}
+
+	// kube stages need a record of what was applied
+	assert.Error(t, Revert(ctx, "config", stages["config"], store, 0))
+
+	require.NoError(t, Forward(ctx, stages, util.Values{}, opts))
+	stages["config"].SetInput([]byte(strings.Replace(testConf, `"data"`, `"changed"`, 1)))
+	require.NoError(t, Forward(ctx, stages, util.Values{}, opts))
+	assert.Equal(t, "changed", data())
+
+	st, err := store.Load()
+	require.NoError(t, err)
+	revisions, err := History(ctx, "config", stages["config"], st)
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+	assert.Equal(t, 1, revisions[0].Revision)
+	assert.Equal(t, 2, revisions[1].Revision)
+	assert.Equal(t, "ConfigMap/config-data", revisions[1].Description)
+
+	assert.Error(t, Revert(ctx, "config", stages["config"], store, 5))
+	require.NoError(t, Revert(ctx, "config", stages["config"], store, 0))
+	assert.Equal(t, "data", data())
+
+	st, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, string(Reverted), st.Stages["config"].Outcome)
+	assert.Equal(t, 1, st.Stages["config"].Run)
+	assert.Len(t, st.Stages["config"].History, 2)
+
+	// there is nothing before the first run
+	assert.Error(t, Revert(ctx, "config", stages["config"], store, 0))
+
+	// the next run applies the stage again
+	stages["config"].SetInput([]byte(strings.Replace(testConf, `"data"`, `"changed"`, 1)))
+	require.NoError(t, Forward(ctx, stages, util.Values{}, opts))
+	assert.Equal(t, "changed", data())
+}
+
+func TestRevertSecrets(t *testing.T) {
+	ctx := context.Background()
+	k8s := kube.NewFakeClient()
+	stages := map[string]*schema.Stage{"secret": newTestManifest()}
+	secret := strings.Replace(testConf, "ConfigMap", "Secret", 1)
+	stages["secret"].SetInput([]byte(secret))
+
+	// a configmap would expose the secret
+	store := &state.Cluster{Namespace: "default", Name: "state", K8s: k8s}
+	opts := Options{Store: store}
+	require.NoError(t, Forward(ctx, stages, util.Values{}, opts))
+	stages["secret"].SetInput([]byte(strings.Replace(secret, `"data"`, `"Y2hhbmdlZA=="`, 1)))
+	require.NoError(t, Forward(ctx, stages, util.Values{}, opts))
+
+	st, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Secret/config-data"}, st.Stages["secret"].Resources)
+	assert.Empty(t, st.Stages["secret"].Snapshot)
+	err = Revert(ctx, "secret", stages["secret"], store, 0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "only kept in a secret:// or file:// state")
+
+	store = &state.Cluster{Secret: true, Namespace: "default", Name: "state", K8s: k8s}
+	require.NoError(t, Forward(ctx, stages, util.Values{}, Options{Store: store}))
+	st, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, stages["secret"].GetInput(), []byte(st.Stages["secret"].Snapshot))
+}
+
+func TestRevertChart(t *testing.T) {
+	ctx := context.Background()
+	stg := newTestChart()
+
+	// charts are rolled back using the history of their release
+	assert.Error(t, Revert(ctx, "chart", stg, nil, 0))
+	revisions, err := History(ctx, "chart", stg, state.New())
+	require.NoError(t, err)
+	assert.Empty(t, revisions)
+
+	nested := &schema.Stage{Actions: schema.Actions{Kind: "workflow"}, Resource: new(Nested)}
+	_, err = History(ctx, "nested", nested, state.New())
+	assert.Error(t, err)
+	assert.Error(t, Revert(ctx, "nested", nested, nil, 0))
+}
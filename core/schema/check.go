@@ -0,0 +1,303 @@
+package schema
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/monax/compass/util"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Problem is a mistake found in a workflow
+type Problem struct {
+	Line    int
+	Column  int
+	Path    string // location in the document, e.g. stages.db.kind
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s", p.Line, p.Column, p.Path, p.Message)
+}
+
+// renamed suggests the current name of keys which were once documented
+var renamed = map[string]string{
+	"abandon":    "forget",
+	"input":      "template",
+	"repository": "name, e.g. stable/chart",
+}
+
+// Check validates the structure of a workflow, reporting unknown keys,
+// wrong types and missing or broken references, stages may also depend
+// on those added by its imports
+func Check(data []byte, imported ...string) ([]Problem, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return []Problem{{Line: 1, Column: 1, Message: "workflow is empty"}}, nil
+	}
+
+	c := &checker{imported: imported}
+	root := resolve(doc.Content[0])
+	if root.Kind != yaml.MappingNode {
+		c.add(root, "", "expected a mapping")
+		return c.problems, nil
+	}
+
+	known := fields(reflect.TypeOf(Workflow{}))
+	delete(known, "stages")
+	names := append(keys(known), "stages")
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], resolve(root.Content[i+1])
+		if key.Value == "stages" {
+			c.stages(value)
+		} else if t, ok := known[key.Value]; ok {
+			c.value(value, t, key.Value)
+		} else {
+			c.unknown(key, "", names)
+		}
+	}
+
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		if c.problems[i].Line == c.problems[j].Line {
+			return c.problems[i].Column < c.problems[j].Column
+		}
+		return c.problems[i].Line < c.problems[j].Line
+	})
+	return c.problems, nil
+}
+
+type checker struct {
+	problems []Problem
+	imported []string // keys of stages from other scrolls
+}
+
+func (c *checker) add(node *yaml.Node, path, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{
+		Line:    node.Line,
+		Column:  node.Column,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *checker) unknown(key *yaml.Node, path string, known []string) {
+	guess, ok := renamed[key.Value]
+	if !ok || !contains(known, strings.Split(guess, ",")[0]) {
+		guess = util.Suggest(key.Value, known)
+	}
+	if guess != "" {
+		c.add(key, join(path, key.Value), "unknown key (did you mean %s?)", guess)
+		return
+	}
+	c.add(key, join(path, key.Value), "unknown key")
+}
+
+// stages checks each stage against the fields of its kind
+func (c *checker) stages(node *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		c.add(node, "stages", "expected a mapping")
+		return
+	}
+
+	var stages []string
+	for i := 0; i < len(node.Content); i += 2 {
+		stages = append(stages, node.Content[i].Value)
+	}
+	stages = append(stages, c.imported...)
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, stage := node.Content[i].Value, resolve(node.Content[i+1])
+		path := join("stages", name)
+		if stage.Kind != yaml.MappingNode {
+			c.add(stage, path, "expected a mapping")
+			continue
+		}
+
+		values := make(map[string]*yaml.Node)
+		for j := 0; j+1 < len(stage.Content); j += 2 {
+			values[stage.Content[j].Value] = resolve(stage.Content[j+1])
+		}
+
+		known := fields(reflect.TypeOf(Actions{}))
+		kind, ok := values["kind"]
+		if !ok {
+			c.add(stage, path, "kind is required")
+			continue
+		}
+		res, ok := kinds[kind.Value]
+		if !ok {
+			c.add(kind, join(path, "kind"), "kind '%s' unknown", kind.Value)
+			continue
+		}
+		for key, t := range fields(fieldsOf(res)) {
+			known[key] = t
+		}
+
+		names := keys(known)
+		for j := 0; j+1 < len(stage.Content); j += 2 {
+			key, value := stage.Content[j], resolve(stage.Content[j+1])
+			if t, ok := known[key.Value]; ok {
+				c.value(value, t, join(path, key.Value))
+			} else {
+				c.unknown(key, path, names)
+			}
+		}
+
+		for _, key := range required(res) {
+			if value, ok := values[key]; !ok || value.Value == "" {
+				c.add(stage, path, "%s is required", res.Required[key])
+			}
+		}
+
+		if tmpl, ok := values["template"]; ok && tmpl.Kind == yaml.ScalarNode && tmpl.Value != "" {
+			if _, err := os.Stat(tmpl.Value); err != nil {
+				c.add(tmpl, join(path, "template"), "template '%s' does not exist", tmpl.Value)
+			}
+		}
+
+		if deps, ok := values["depends"]; ok && deps.Kind == yaml.SequenceNode {
+			for _, dep := range deps.Content {
+				if contains(stages, dep.Value) {
+					continue
+				} else if guess := util.Suggest(dep.Value, stages); guess != "" {
+					c.add(dep, join(path, "depends"), "stage %s does not exist (did you mean %s?)", dep.Value, guess)
+				} else {
+					c.add(dep, join(path, "depends"), "stage %s does not exist", dep.Value)
+				}
+			}
+		}
+	}
+}
+
+// value checks that the node can be decoded into the given type
+func (c *checker) value(node *yaml.Node, t reflect.Type, path string) {
+	node = resolve(node)
+	if node.Tag == "!!null" {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		c.value(node, t.Elem(), path)
+	case reflect.Interface:
+		// anything goes
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			c.add(node, path, "expected a mapping")
+			return
+		}
+		known := fields(t)
+		names := keys(known)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if ft, ok := known[key.Value]; ok {
+				c.value(node.Content[i+1], ft, join(path, key.Value))
+			} else {
+				c.unknown(key, path, names)
+			}
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			c.add(node, path, "expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			c.value(node.Content[i+1], t.Elem(), join(path, node.Content[i].Value))
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			c.scalar(node, t, path)
+			return
+		} else if node.Kind != yaml.SequenceNode {
+			c.add(node, path, "expected a list")
+			return
+		}
+		for i, item := range node.Content {
+			c.value(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	default:
+		c.scalar(node, t, path)
+	}
+}
+
+func (c *checker) scalar(node *yaml.Node, t reflect.Type, path string) {
+	if node.Kind != yaml.ScalarNode {
+		c.add(node, path, "expected a %s", describe(t))
+		return
+	}
+	if err := node.Decode(reflect.New(t).Interface()); err != nil {
+		c.add(node, path, "expected a %s, got '%s'", describe(t), node.Value)
+	}
+}
+
+// fields lists the yaml keys of a struct, including those inlined
+func fields(t reflect.Type) map[string]reflect.Type {
+	known := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("yaml")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		if len(parts) > 1 && parts[1] == "inline" {
+			for key, ft := range fields(field.Type) {
+				known[key] = ft
+			}
+			continue
+		}
+		known[parts[0]] = field.Type
+	}
+	return known
+}
+
+func describe(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "number"
+	}
+	return "string"
+}
+
+// resolve follows aliases to the node they refer to
+func resolve(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+func keys(known map[string]reflect.Type) []string {
+	names := make([]string, 0, len(known))
+	for key := range known {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,69 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func messages(problems []Problem) []string {
+	out := make([]string, len(problems))
+	for i, p := range problems {
+		out[i] = p.String()
+	}
+	return out
+}
+
+func TestCheck(t *testing.T) {
+	problems, err := Check([]byte(`
+concurrency:
+  stages: many
+stagse: {}
+stages:
+  ipfs:
+    kind: helm
+    release: my-release
+    repository: stable
+    abandon: true
+  add:
+    kind: kube
+    depends:
+    - ipsf
+    requries:
+      add: true
+    template: missing.yaml
+  other:
+    kind: docker
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"3:11: concurrency.stages: expected a number, got 'many'",
+		"4:1: stagse: unknown key (did you mean stages?)",
+		"7:5: stages.ipfs: chart name is required",
+		"9:5: stages.ipfs.repository: unknown key (did you mean name, e.g. stable/chart?)",
+		"10:5: stages.ipfs.abandon: unknown key (did you mean forget?)",
+		"14:7: stages.add.depends: stage ipsf does not exist (did you mean ipfs?)",
+		"15:5: stages.add.requries: unknown key (did you mean requires?)",
+		"17:15: stages.add.template: template 'missing.yaml' does not exist",
+		"19:11: stages.other.kind: kind 'docker' unknown",
+	}, messages(problems))
+
+	problems, err = Check([]byte(`
+values:
+  namespace: default
+stages:
+  chart:
+    kind: helm
+    name: stable/chart
+    forget: true
+    timeout: 60
+    labels:
+      tier: backend
+`))
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	_, err = Check([]byte("stages: ["))
+	assert.Error(t, err)
+}
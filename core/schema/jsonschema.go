@@ -0,0 +1,122 @@
+package schema
+
+import (
+	"reflect"
+	"sort"
+)
+
+// JSONSchema describes the scroll format so that editors can
+// autocomplete and validate workflows, the fields allowed in
+// a stage depend on its kind as in Stage.UnmarshalYAML
+func JSONSchema() map[string]interface{} {
+	definitions := map[string]interface{}{
+		"image": typeSchema(reflect.TypeOf(Image{})),
+	}
+
+	names := make([]string, 0, len(kinds))
+	for kind := range kinds {
+		names = append(names, kind)
+	}
+	sort.Strings(names)
+
+	conditions := make([]interface{}, 0, len(names))
+	for _, kind := range names {
+		def := typeSchema(reflect.TypeOf(Actions{}))
+		props := def["properties"].(map[string]interface{})
+		for key, t := range fields(fieldsOf(kinds[kind])) {
+			props[key] = typeSchema(t)
+		}
+		props["kind"] = map[string]interface{}{"const": kind}
+		def["required"] = append([]string{"kind"}, required(kinds[kind])...)
+		definitions[kind] = def
+
+		conditions = append(conditions, map[string]interface{}{
+			"if":   map[string]interface{}{"properties": map[string]interface{}{"kind": map[string]interface{}{"const": kind}}},
+			"then": map[string]interface{}{"$ref": "#/definitions/" + kind},
+		})
+	}
+
+	definitions["stage"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"kind"},
+		"properties": map[string]interface{}{
+			"kind": map[string]interface{}{"enum": names},
+		},
+		"allOf": conditions,
+	}
+
+	root := typeSchema(reflect.TypeOf(Workflow{}))
+	root["$schema"] = "http://json-schema.org/draft-07/schema#"
+	root["title"] = "Compass scroll"
+	root["properties"].(map[string]interface{})["build"] = array("#/definitions/image")
+	root["properties"].(map[string]interface{})["tag"] = array("#/definitions/image")
+	root["properties"].(map[string]interface{})["stages"] = map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": map[string]interface{}{"$ref": "#/definitions/stage"},
+	}
+	root["definitions"] = definitions
+	return root
+}
+
+func array(ref string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":  "array",
+		"items": map[string]interface{}{"$ref": ref},
+	}
+}
+
+// typeSchema returns the schema for the given go type
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(Policy("")) {
+		return map[string]interface{}{
+			"type": "string",
+			"enum": []Policy{Abort, Continue, Rollback},
+		}
+	}
+
+	if t == reflect.TypeOf(Render("")) {
+		return map[string]interface{}{
+			"type": "string",
+			"enum": []Render{Eager, Lazy},
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for key, ft := range fields(t) {
+			props[key] = typeSchema(ft)
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.Interface {
+			return map[string]interface{}{"type": "object"}
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem()),
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string"}
+		}
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	}
+	return map[string]interface{}{}
+}
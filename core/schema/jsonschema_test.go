@@ -0,0 +1,34 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONSchema(t *testing.T) {
+	out, err := json.Marshal(JSONSchema())
+	require.NoError(t, err)
+
+	var doc struct {
+		Properties  map[string]interface{} `json:"properties"`
+		Definitions map[string]struct {
+			Required   []string               `json:"required"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"definitions"`
+	}
+	require.NoError(t, json.Unmarshal(out, &doc))
+
+	assert.Contains(t, doc.Properties, "stages")
+	assert.Contains(t, doc.Properties, "onFailure")
+	assert.Equal(t, []string{"kind", "name"}, doc.Definitions["helm"].Required)
+	assert.Contains(t, doc.Definitions["helm"].Properties, "release")
+	assert.NotContains(t, doc.Definitions["helm"].Properties, "remove")
+	assert.Contains(t, doc.Definitions["kube"].Properties, "remove")
+	for key := range fields(reflect.TypeOf(Actions{})) {
+		assert.Contains(t, doc.Definitions["kube"].Properties, key)
+	}
+}
@@ -0,0 +1,51 @@
+package schema
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/kube"
+)
+
+// Kind describes a type of stage
+type Kind struct {
+	New      func() Resource   // creates the resource with its defaults
+	Required map[string]string // keys which must be set, described for errors
+}
+
+// kinds of stage, keyed as in the scroll
+var kinds = map[string]Kind{
+	"helm": {
+		New:      func() Resource { return &helm.Chart{Timeout: 300} },
+		Required: map[string]string{"name": "chart name"},
+	},
+	"kube": {
+		New:      func() Resource { return &kube.Manifest{Timeout: 300} },
+		Required: map[string]string{"template": "template"},
+	},
+	"kubernetes": {
+		New:      func() Resource { return &kube.Manifest{Timeout: 300} },
+		Required: map[string]string{"template": "template"},
+	},
+}
+
+// Register adds a kind of stage which is defined outside of this package
+func Register(name string, kind Kind) {
+	kinds[name] = kind
+}
+
+// fieldsOf returns the type holding the fields of the given kind
+func fieldsOf(kind Kind) reflect.Type {
+	return reflect.TypeOf(kind.New()).Elem()
+}
+
+// required lists the keys which must be set for the given kind
+func required(kind Kind) []string {
+	keys := make([]string, 0, len(kind.Required))
+	for key := range kind.Required {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,10 +1,10 @@
 package schema
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
-	"github.com/monax/compass/helm"
-	"github.com/monax/compass/kube"
 	"github.com/monax/compass/util"
 )
 
@@ -15,12 +15,66 @@ type Image struct {
 	Args      map[string]*string `yaml:"args"`
 }
 
+// Policy determines what happens when a stage fails
+type Policy string
+
+const (
+	Abort    Policy = "abort"    // cancel everything in-flight
+	Continue Policy = "continue" // run anything not dependent on the failure
+	Rollback Policy = "rollback" // undo the stage, then continue
+)
+
+// Validate checks that the policy is known
+func (p Policy) Validate() error {
+	switch p {
+	case "", Abort, Continue, Rollback:
+		return nil
+	}
+	return fmt.Errorf("failure policy '%s' unknown", p)
+}
+
+// Render determines when the template of a stage is rendered
+type Render string
+
+const (
+	Eager Render = "eager" // before the workflow starts
+	Lazy  Render = "lazy"  // once the dependencies of the stage are applied
+)
+
+// Validate checks that the render mode is known
+func (r Render) Validate() error {
+	switch r {
+	case "", Eager, Lazy:
+		return nil
+	}
+	return fmt.Errorf("render '%s' should be eager or lazy", r)
+}
+
+// Concurrency limits how much work is done at once, zero is unlimited
+type Concurrency struct {
+	Stages  int `yaml:"stages"`  // stages running at the same time
+	Objects int `yaml:"objects"` // objects applied at the same time per manifest
+}
+
+// Import pulls the stages and values of another scroll into a workflow
+type Import struct {
+	Scroll string `yaml:"scroll"` // path to the scroll, within the repository if git is set
+	Git    string `yaml:"git"`    // repository to clone
+	Ref    string `yaml:"ref"`    // branch, tag or commit to check out
+	As     string `yaml:"as"`     // prefix for the imported stages, defaults to the file name
+}
+
 // Workflow represents the complete pipeline
 type Workflow struct {
-	Build  []Image           `yaml:"build"`
-	Tag    []Image           `yaml:"tag"`
-	Stages map[string]*Stage `yaml:"stages"`
-	Values util.Values       `yaml:"values"`
+	Imports     []Import          `yaml:"imports"`
+	Build       []Image           `yaml:"build"`
+	Tag         []Image           `yaml:"tag"`
+	Stages      map[string]*Stage `yaml:"stages"`
+	Values      util.Values       `yaml:"values"`
+	OnFailure   Policy            `yaml:"onFailure"`
+	Concurrency Concurrency       `yaml:"concurrency"`
+	Render      Render            `yaml:"render"` // default for each stage
+	Helm        int               `yaml:"helm"`   // default major version of helm for each chart
 }
 
 func NewWorkflow() *Workflow {
@@ -38,27 +92,81 @@ type Jobs struct {
 	After  []string `yaml:"after"`
 }
 
+// Output captures a value once a stage has been applied, from
+// one of an object in a manifest, the release or an after job
+type Output struct {
+	Object  string `yaml:"object"`  // kubernetes object as Kind/name
+	Release string `yaml:"release"` // helm release notes, values, manifest or version
+	Job     *int   `yaml:"job"`     // index of the after job to read stdout from
+	Path    string `yaml:"path"`    // dotted path within the object or values
+}
+
+// Validate checks that exactly one source is given
+func (out Output) Validate(kind string, jobs int) error {
+	sources := 0
+	if out.Object != "" {
+		sources++
+		if kind != "kube" && kind != "kubernetes" {
+			return fmt.Errorf("object is only supported by kube stages")
+		} else if strings.Count(out.Object, "/") != 1 {
+			return fmt.Errorf("object '%s' should be Kind/name", out.Object)
+		} else if out.Path == "" {
+			return fmt.Errorf("path is required to read from an object")
+		}
+	}
+	if out.Release != "" {
+		sources++
+		if kind != "helm" {
+			return fmt.Errorf("release is only supported by helm stages")
+		}
+		switch out.Release {
+		case "notes", "values", "manifest", "version":
+		default:
+			return fmt.Errorf("release '%s' should be notes, values, manifest or version", out.Release)
+		}
+	}
+	if out.Job != nil {
+		sources++
+		if *out.Job < 0 || *out.Job >= jobs {
+			return fmt.Errorf("job %d does not exist", *out.Job)
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("one of object, release or job is required")
+	}
+	return nil
+}
+
 // Stage represents a single part of the deployment pipeline
 type Stage struct {
 	Actions `yaml:",inline"`
 	Resource
+	Scope util.Values `yaml:"-" json:"-"` // item and index of an expanded stage
 }
 
 type Actions struct {
-	Depends  []string    `yaml:"depends"`  // dependencies
-	Forget   bool        `yaml:"forget"`   // install only
-	Template string      `yaml:"template"` // template file
-	Jobs     Jobs        `yaml:"jobs"`     // bash jobs
-	Kind     string      `yaml:"kind"`     // type of deploy
-	Requires util.Values `yaml:"requires"` // env requirements
+	Depends   []string          `yaml:"depends"`   // dependencies
+	Forget    bool              `yaml:"forget"`    // install only
+	Template  string            `yaml:"template"`  // template file
+	Jobs      Jobs              `yaml:"jobs"`      // bash jobs
+	Kind      string            `yaml:"kind"`      // type of deploy
+	Requires  util.Values       `yaml:"requires"`  // env requirements
+	OnFailure Policy            `yaml:"onFailure"` // overrides workflow policy
+	Labels    map[string]string `yaml:"labels"`    // used to select stages
+	Outputs   map[string]Output `yaml:"outputs"`   // values captured for dependants
+	Render    Render            `yaml:"render"`    // when to render the template
+	When      string            `yaml:"when"`      // template deciding if the stage runs
+	Foreach   interface{}       `yaml:"foreach"`   // list, or path to one in the values, to expand
 }
 
 // Resource is the thing to be created / destroyed
 type Resource interface {
 	Lint(string, *util.Values) error
-	Status() (bool, error)
-	InstallOrUpgrade() error
-	Delete() error
+	Status(context.Context) (bool, error)
+	InstallOrUpgrade(context.Context) error
+	Rollback(context.Context) error
+	Delete(context.Context) error
+	Diff(context.Context) (string, error)
 	Connect(interface{})
 	SetInput([]byte)
 	GetInput() []byte
@@ -72,24 +180,15 @@ func (stg *Stage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	}
 
 	stg.Actions = *act
-	switch act.Kind {
-	case "kube", "kubernetes":
-		var km kube.Manifest
-		km.Timeout = 300
-		if err := unmarshal(&km); err != nil {
-			return err
-		}
-		stg.Resource = &km
-	case "helm":
-		var hc helm.Chart
-		hc.Timeout = 300
-		if err := unmarshal(&hc); err != nil {
-			return err
-		}
-		stg.Resource = &hc
-	default:
+	kind, ok := kinds[act.Kind]
+	if !ok {
 		return fmt.Errorf("kind '%s' unknown", act.Kind)
 	}
+	res := kind.New()
+	if err := unmarshal(res); err != nil {
+		return err
+	}
+	stg.Resource = res
 
 	return nil
 }
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/monax/compass/core/schema"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Selection narrows down which stages in a workflow are run
+type Selection struct {
+	Only     []string // stage names to run
+	Exclude  []string // stage names not to run
+	Selector string   // label selector, e.g. tier=backend
+	WithDeps bool     // also run the dependencies of selected stages
+}
+
+// Empty returns true if every stage is selected
+func (sel Selection) Empty() bool {
+	return len(sel.Only) == 0 && len(sel.Exclude) == 0 && sel.Selector == "" && !sel.WithDeps
+}
+
+// Select filters the stages, dependencies which are not selected are assumed
+// to be satisfied and are removed from the copies of their dependants
+func Select(stages map[string]*schema.Stage, sel Selection) (map[string]*schema.Stage, error) {
+	if sel.Empty() {
+		return stages, nil
+	}
+
+	for _, key := range append(sel.Only, sel.Exclude...) {
+		if _, ok := stages[key]; !ok {
+			return nil, fmt.Errorf("stage %s does not exist", key)
+		}
+	}
+
+	selector, err := labels.Parse(sel.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("selector '%s' not valid: %v", sel.Selector, err)
+	}
+
+	only := make(map[string]bool, len(sel.Only))
+	for _, key := range sel.Only {
+		only[key] = true
+	}
+
+	var keys []string
+	for key, stg := range stages {
+		if len(only) > 0 && !only[key] {
+			continue
+		} else if !selector.Matches(labels.Set(stg.Labels)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	picked := make(map[string]*schema.Stage, len(keys))
+	for _, key := range keys {
+		picked[key] = stages[key]
+	}
+	if sel.WithDeps {
+		if picked, err = Closure(stages, keys...); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range sel.Exclude {
+		delete(picked, key)
+	}
+
+	if len(picked) == 0 {
+		return nil, fmt.Errorf("no stages selected")
+	}
+
+	selected := make(map[string]*schema.Stage, len(picked))
+	for key, stg := range picked {
+		trimmed := *stg
+		trimmed.Depends = nil
+		for _, dep := range stg.Depends {
+			if _, ok := picked[dep]; ok {
+				trimmed.Depends = append(trimmed.Depends, dep)
+			}
+		}
+		selected[key] = &trimmed
+	}
+	return selected, nil
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func selected(stages map[string]*schema.Stage) []string {
+	keys := make([]string, 0, len(stages))
+	for key := range stages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestSelect(t *testing.T) {
+	stages := newTestResources("db", "api", "web", "docs")
+	stages["db"].Labels = map[string]string{"tier": "backend"}
+	stages["api"].Labels = map[string]string{"tier": "backend"}
+	stages["web"].Labels = map[string]string{"tier": "frontend"}
+	stages["api"].Depends = []string{"db"}
+	stages["web"].Depends = []string{"api"}
+
+	all, err := Select(stages, Selection{})
+	require.NoError(t, err)
+	assert.Len(t, all, 4)
+
+	only, err := Select(stages, Selection{Only: []string{"web"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web"}, selected(only))
+	assert.Empty(t, only["web"].Depends)
+	assert.Equal(t, []string{"api"}, stages["web"].Depends, "original should not change")
+
+	deps, err := Select(stages, Selection{Only: []string{"web"}, WithDeps: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api", "db", "web"}, selected(deps))
+
+	backend, err := Select(stages, Selection{Selector: "tier=backend"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api", "db"}, selected(backend))
+	assert.Equal(t, []string{"db"}, backend["api"].Depends)
+
+	excluded, err := Select(stages, Selection{Selector: "tier", Exclude: []string{"db"}, WithDeps: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api", "web"}, selected(excluded))
+	assert.Empty(t, excluded["api"].Depends)
+
+	_, err = Select(stages, Selection{Only: []string{"nope"}})
+	assert.EqualError(t, err, "stage nope does not exist")
+	_, err = Select(stages, Selection{Selector: "tier=none"})
+	assert.EqualError(t, err, "no stages selected")
+}
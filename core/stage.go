@@ -1,12 +1,16 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"text/template"
 
 	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/helm"
 	"github.com/monax/compass/util"
 	log "github.com/sirupsen/logrus"
 )
@@ -15,87 +19,164 @@ func checkRequires(values util.Values, reqs util.Values) error {
 	for k, v := range reqs {
 		if _, exists := values[k]; !exists {
 			return fmt.Errorf("argument '%s' not given", k)
-		} else if values[k] != v {
-			return fmt.Errorf("argument '%s' not given value '%s'", k, v)
+		} else if fmt.Sprint(values[k]) != fmt.Sprint(v) {
+			// values given on the command line are strings, but not those in a scroll
+			return fmt.Errorf("argument '%s' not given value '%v'", k, v)
 		}
 	}
 	return nil
 }
 
-// Create installs / upgrades resource
-func Create(stg *schema.Stage, logger *log.Entry, key string, global util.Values, force bool) error {
+// checkWhen evaluates the condition of a stage, which holds unless
+// it renders as empty, a missing value or something false like 0
+func checkWhen(values util.Values, when string, funcs template.FuncMap) (bool, error) {
+	if when == "" {
+		return true, nil
+	}
+	out, err := util.Render("when", []byte(when), values, funcs)
+	if err != nil {
+		return false, fmt.Errorf("couldn't evaluate condition: %v", err)
+	}
+	result := strings.TrimSpace(string(out))
+	if ok, err := strconv.ParseBool(result); err == nil {
+		return ok, nil
+	}
+	return result != "" && result != "<no value>", nil
+}
+
+// ignore returns the reason a stage should not be installed, if any
+func ignore(stg *schema.Stage, installed bool, global util.Values, opts Options) (string, error) {
 	// stop if already installed and abandoned
-	installed, _ := stg.Status()
-	if installed && !force && stg.Forget {
-		logger.Infof("Ignoring: %s", key)
-		return nil
+	if installed && !opts.Force && stg.Forget {
+		return "installed and forgotten", nil
+	}
+	if err := checkRequires(global, stg.Requires); err != nil {
+		return err.Error(), nil
 	}
+	if ok, err := checkWhen(global, stg.When, opts.Funcs); err != nil {
+		return "", err
+	} else if !ok {
+		return "condition not met", nil
+	}
+	return "", nil
+}
 
+// spare returns the reason a stage should not be deleted, if any
+func spare(stg *schema.Stage, global util.Values, opts Options) (string, error) {
+	// only continue if required variables are set
 	if err := checkRequires(global, stg.Requires); err != nil {
-		logger.Infof("Ignoring: %s: %s", key, err.Error())
-		return nil
+		return err.Error(), nil
+	}
+	if ok, err := checkWhen(global, stg.When, opts.Funcs); err != nil {
+		return "", err
+	} else if !ok {
+		return "condition not met", nil
+	}
+	// don't delete by default
+	if !opts.Force && stg.Forget {
+		return "forgotten", nil
+	}
+	return "", nil
+}
+
+// Create installs / upgrades resource
+func Create(ctx context.Context, stg *schema.Stage, logger *log.Entry, key string, global util.Values, opts Options) (Outcome, error) {
+	out, _, err := install(ctx, stg, logger, key, global, opts)
+	return out, err
+}
+
+// install creates the resource, returning the output of each after job
+func install(ctx context.Context, stg *schema.Stage, logger *log.Entry, key string, global util.Values, opts Options) (Outcome, []string, error) {
+	installed, state := status(ctx, stg)
+	if reason, err := ignore(stg, installed, global, opts); err != nil {
+		return Failed, nil, err
+	} else if reason != "" {
+		logger.Infof("Ignoring: %s: %s", key, reason)
+		return Ignored, nil, nil
 	}
 
 	shellVars := global.ToSlice()
-	if err := shellTasks(stg.Jobs.Before, shellVars); err != nil {
-		return err
+	if _, err := shellTasks(ctx, stg.Jobs.Before, shellVars, opts.DryRun); err != nil {
+		return Failed, nil, err
 	}
 
 	if obj := stg.GetInput(); obj != nil {
 		fmt.Println(string(obj))
 	}
 
-	logger.Infof("Installing: %s", key)
-	if err := stg.InstallOrUpgrade(); err != nil {
-		logger.Fatalf("Failed to install %s: %s", key, err)
-		return err
+	if state != "" {
+		logger.Infof("Installing: %s (%s)", key, state)
+	} else {
+		logger.Infof("Installing: %s", key)
+	}
+	if err := stg.InstallOrUpgrade(ctx); err != nil {
+		logger.Errorf("Failed to install %s: %s", key, err)
+		return Failed, nil, err
 	}
 	logger.Infof("Installed: %s", key)
 
-	if err := shellTasks(stg.Jobs.After, shellVars); err != nil {
-		return err
+	stdout, err := shellTasks(ctx, stg.Jobs.After, shellVars, opts.DryRun)
+	if err != nil {
+		return Failed, nil, err
 	}
 
-	return nil
+	return Succeeded, stdout, nil
 }
 
-// Destroy removes resource
-func Destroy(stg *schema.Stage, logger *log.Entry, key string, global util.Values, force bool) error {
-	// only continue if required variables are set
-	if err := checkRequires(global, stg.Requires); err != nil {
-		logger.Infof("Ignoring: %s: %s", key, err.Error())
-		return nil
+// status checks if the resource is installed, also describing the release of a chart
+func status(ctx context.Context, stg *schema.Stage) (bool, string) {
+	if chart, ok := stg.Resource.(*helm.Chart); ok {
+		st, _ := chart.ReleaseStatus(ctx)
+		return st.Installed(), st.String()
 	}
+	installed, _ := stg.Status(ctx)
+	return installed, ""
+}
 
-	// don't delete by default
-	if !force && stg.Forget {
-		logger.Infof("Ignoring: %s", key)
-		return fmt.Errorf("Not deleting stage %s", key)
+// Destroy removes resource
+func Destroy(ctx context.Context, stg *schema.Stage, logger *log.Entry, key string, global util.Values, opts Options) (Outcome, error) {
+	if reason, err := spare(stg, global, opts); err != nil {
+		return Failed, err
+	} else if reason != "" {
+		logger.Infof("Ignoring: %s: %s", key, reason)
+		return Ignored, nil
 	}
 
 	logger.Infof("Deleting: %s", key)
+	if err := stg.Delete(ctx); err != nil {
+		logger.Errorf("Failed to delete %s: %s", key, err)
+		return Failed, err
+	}
+	logger.Infof("Deleted: %s", key)
 
-	return stg.Delete()
+	return Succeeded, nil
 }
 
-func shellTasks(jobs []string, values []string) error {
-	for _, command := range jobs {
+// shellTasks runs each job in turn, returning what they printed
+func shellTasks(ctx context.Context, jobs []string, values []string, dryRun bool) ([]string, error) {
+	stdout := make([]string, len(jobs))
+	for i, command := range jobs {
+		if dryRun {
+			log.Infof("would run job: %s\n", command)
+			continue
+		}
 		log.Infof("running job: %s\n", command)
-		out, err := Shell(command, values)
+		out, err := Shell(ctx, command, values)
 		if out != nil {
 			fmt.Println(string(out))
+			stdout[i] = strings.TrimSpace(string(out))
 		}
 		if err != nil {
-			return fmt.Errorf("job '%s' exited with error: %v", command, err)
+			return nil, fmt.Errorf("job '%s' exited with error: %v", command, err)
 		}
 	}
-	return nil
+	return stdout, nil
 }
 
-// Shell runs any given command
-func Shell(command string, values []string) ([]byte, error) {
+// Shell runs any given command, killing it if the context is done
+func Shell(ctx context.Context, command string, values []string) ([]byte, error) {
 	args := strings.Fields(command)
-	cmd := exec.Command(args[0], args[1:]...)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 	cmd.Env = append(values, os.Environ()...)
 	return cmd.Output()
 }
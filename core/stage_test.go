@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"testing"
 
 	"github.com/monax/compass/core/schema"
@@ -9,6 +10,7 @@ import (
 	"github.com/monax/compass/util"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func newTestChart() *schema.Stage {
@@ -56,12 +58,17 @@ func newTestManifest() *schema.Stage {
 
 func TestShellTasks(t *testing.T) {
 	jobs := []string{"echo hello"}
-	err := shellTasks(jobs, nil)
+	out, err := shellTasks(context.Background(), jobs, nil, false)
 	assert.NoError(t, err)
+	assert.Equal(t, []string{"hello"}, out)
 
 	jobs = []string{"error 1"}
-	err = shellTasks(jobs, nil)
+	_, err = shellTasks(context.Background(), jobs, nil, false)
 	assert.Error(t, err)
+
+	// not executed
+	_, err = shellTasks(context.Background(), jobs, nil, true)
+	assert.NoError(t, err)
 }
 
 func TestCreateDestroyChart(t *testing.T) {
@@ -69,10 +76,10 @@ func TestCreateDestroyChart(t *testing.T) {
 
 	logger := logrus.New().WithField("kind", chart.Kind)
 	values := make(util.Values, 1)
-	err := Create(chart, logger, "test", values, false)
+	_, err := Create(context.Background(), chart, logger, "test", values, Options{})
 	assert.NoError(t, err)
 
-	err = Destroy(chart, logger, "test", values, false)
+	_, err = Destroy(context.Background(), chart, logger, "test", values, Options{})
 	assert.NoError(t, err)
 }
 
@@ -81,9 +88,48 @@ func TestCreateDestroyManifest(t *testing.T) {
 
 	logger := logrus.New().WithField("kind", man.Kind)
 	values := make(util.Values, 1)
-	err := Create(man, logger, "test", values, false)
+	out, err := Create(context.Background(), man, logger, "test", values, Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, Succeeded, out)
+
+	out, err = Destroy(context.Background(), man, logger, "test", values, Options{})
 	assert.NoError(t, err)
+	assert.Equal(t, Succeeded, out)
+}
+
+func TestCreateRequires(t *testing.T) {
+	man := newTestManifest()
+	man.Requires = util.Values{"deploy": "true"}
 
-	err = Destroy(man, logger, "test", values, false)
+	logger := logrus.New().WithField("kind", man.Kind)
+	out, err := Create(context.Background(), man, logger, "test", util.Values{"deploy": "false"}, Options{})
 	assert.NoError(t, err)
+	assert.Equal(t, Ignored, out)
+
+	assert.NoError(t, checkRequires(util.Values{"add": "true"}, util.Values{"add": true}))
+	assert.EqualError(t, checkRequires(util.Values{"add": false}, util.Values{"add": true}), "argument 'add' not given value 'true'")
+}
+
+func TestCheckWhen(t *testing.T) {
+	values := util.Values{"env": "prod", "replicas": 3, "monitoring": true}
+	funcs := RenderWith(nil)
+
+	for when, expected := range map[string]bool{
+		``:                                          true,
+		`{{ .monitoring }}`:                         true,
+		`{{ .missing }}`:                            false,
+		`{{ and .monitoring (ne .env "dev") }}`:     true,
+		`{{ eq .env "dev" }}`:                       false,
+		`{{ gt .replicas 2 }}`:                      true,
+		`{{ regexMatch "^pr" .env }}`:               true,
+		`{{ not (empty .missing) }}`:                false,
+		`{{ if .monitoring }}0{{ else }}1{{ end }}`: false,
+	} {
+		ok, err := checkWhen(values, when, funcs)
+		require.NoError(t, err, when)
+		assert.Equal(t, expected, ok, when)
+	}
+
+	_, err := checkWhen(values, `{{ gt .env 2 }}`, funcs)
+	assert.Error(t, err)
 }
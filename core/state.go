@@ -0,0 +1,326 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/kube"
+	"github.com/monax/compass/state"
+	"github.com/monax/compass/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Fingerprints hashes the definition and rendered input of each stage,
+// including the fingerprints of its dependencies so that changes cascade
+func Fingerprints(ctx context.Context, stages map[string]*schema.Stage) (map[string]string, error) {
+	hashes := make(map[string]string, len(stages))
+	visiting := make(map[string]bool, len(stages))
+
+	var visit func(key string) error
+	visit = func(key string) error {
+		if _, ok := hashes[key]; ok {
+			return nil
+		} else if visiting[key] {
+			return fmt.Errorf("cycle in dependencies")
+		}
+		stg, ok := stages[key]
+		if !ok {
+			return fmt.Errorf("dependency %s does not exist", key)
+		}
+		visiting[key] = true
+
+		for _, dep := range stg.Depends {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+
+		hash, err := fingerprint(ctx, stg, hashes)
+		if err != nil {
+			return fmt.Errorf("couldn't hash %s: %v", key, err)
+		}
+		hashes[key] = hash
+		return nil
+	}
+
+	for key := range stages {
+		if err := visit(key); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// fingerprint hashes a single stage given the fingerprints of its dependencies,
+// along with what it points to: a local chart or the stages of a nested scroll
+func fingerprint(ctx context.Context, stg *schema.Stage, hashes map[string]string) (string, error) {
+	def, err := json.Marshal(stg)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(stg.Kind))
+	h.Write(stg.GetInput())
+	h.Write(def)
+	if stg.GetInput() == nil && stg.Template != "" {
+		// not rendered yet, so at least notice if the template changes
+		data, err := ioutil.ReadFile(stg.Template)
+		if err != nil {
+			return "", err
+		}
+		h.Write(data)
+	}
+
+	switch res := stg.Resource.(type) {
+	case *helm.Chart:
+		if util.IsDir(res.Name) {
+			if err = digest(h, res.Name); err != nil {
+				return "", err
+			}
+		}
+	case *Nested:
+		wf, err := res.load(ctx)
+		if err != nil {
+			return "", err
+		}
+		nested, err := Fingerprints(ctx, wf.Stages)
+		if err != nil {
+			return "", err
+		}
+		keys := make([]string, 0, len(nested))
+		for key := range nested {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h.Write([]byte(key + "=" + nested[key]))
+		}
+	}
+
+	deps := append([]string(nil), stg.Depends...)
+	sort.Strings(deps)
+	for _, dep := range deps {
+		h.Write([]byte(dep + "=" + hashes[dep]))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digest writes the name and contents of each file beneath the directory
+func digest(w io.Writer, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s:%d\n", name, len(data))
+		_, err = w.Write(data)
+		return err
+	})
+}
+
+// tracker keeps the persisted state up to date as stages complete
+type tracker struct {
+	mu       *sync.Mutex
+	store    state.Store
+	state    *state.State
+	hashes   map[string]string
+	writable bool
+	prefix   string // of the records of nested stages
+}
+
+// newTracker loads the previous state, if there is a store, and
+// starts a new run unless it is read only
+func newTracker(opts Options, writable bool) (*tracker, error) {
+	t := &tracker{mu: new(sync.Mutex), store: opts.Store, state: state.New(), hashes: make(map[string]string), writable: writable}
+	if opts.Store == nil {
+		if opts.Resume {
+			return nil, fmt.Errorf("resume requires a state store")
+		}
+		return t, nil
+	}
+
+	var err error
+	if t.state, err = opts.Store.Load(); err != nil {
+		return nil, fmt.Errorf("couldn't load state: %v", err)
+	}
+
+	if opts.Resume {
+		if t.state.Run == 0 {
+			return nil, fmt.Errorf("no previous run to resume")
+		} else if t.state.Scroll != "" && t.state.Scroll != opts.Scroll {
+			return nil, fmt.Errorf("previous run was of %s, not %s", t.state.Scroll, opts.Scroll)
+		}
+	}
+
+	t.update(func(st *state.State) {
+		st.Run++
+		if opts.Scroll != "" {
+			st.Scroll = opts.Scroll
+		}
+	})
+	return t, nil
+}
+
+// nested tracks the stages of a nested scroll as part of the same run,
+// recording them beneath the key of the stage which runs them
+func (t *tracker) nested(key string) *tracker {
+	n := *t
+	n.hashes = make(map[string]string)
+	n.prefix = t.prefix + key + "/"
+	return &n
+}
+
+// hash fingerprints the stage once it has been rendered, stages
+// are hashed in order so those of its dependencies are known
+func (t *tracker) hash(ctx context.Context, key string, stg *schema.Stage) {
+	if t.store == nil {
+		return
+	}
+	t.mu.Lock()
+	deps := make(map[string]string, len(stg.Depends))
+	for _, dep := range stg.Depends {
+		deps[dep] = t.hashes[dep]
+	}
+	t.mu.Unlock()
+
+	// nested scrolls may take a while to load
+	hash, err := fingerprint(ctx, stg, deps)
+	if err != nil {
+		log.Warnf("Couldn't hash %s: %v", key, err)
+	}
+	t.mu.Lock()
+	t.hashes[key] = hash
+	t.mu.Unlock()
+}
+
+// resumable returns the record of the stage if the previous run applied it
+// successfully and it has not changed since
+func (t *tracker) resumable(key string) *state.Record {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rec, ok := t.state.Stages[t.prefix+key]
+	if !ok || rec.Outcome != string(Succeeded) {
+		return nil
+	} else if rec.Run != t.state.Run-1 || rec.Hash != t.hashes[key] {
+		// skipped by the previous run, or changed since
+		return nil
+	}
+	return rec
+}
+
+// unchanged returns the last record of the stage if it succeeded with the same input
+func (t *tracker) unchanged(key string) *state.Record {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.store == nil {
+		return nil
+	}
+	rec, ok := t.state.Stages[t.prefix+key]
+	if !ok || rec.Outcome != string(Succeeded) || rec.Hash != t.hashes[key] {
+		return nil
+	}
+	return rec
+}
+
+// record saves the outcome of an install / upgrade
+func (t *tracker) record(key string, stg *schema.Stage, out Outcome, captured map[string]string) {
+	if out != Succeeded && out != Failed {
+		return
+	}
+
+	t.mu.Lock()
+	rec := &state.Record{
+		Hash:    t.hashes[key],
+		Outcome: string(out),
+		Outputs: jobOutputs(stg, captured),
+		Applied: time.Now().UTC(),
+	}
+	t.mu.Unlock()
+	switch res := stg.Resource.(type) {
+	case *helm.Chart:
+		rec.Version = res.Released()
+		rec.Resources = []string{"release/" + res.Release}
+	case *kube.Manifest:
+		rec.Resources = res.Names()
+		if !secrets(rec.Resources) || state.Private(t.store) {
+			rec.Snapshot = string(res.GetInput())
+		} else {
+			log.Warnf("Not keeping a snapshot of %s, its secrets would be readable in the state", key)
+		}
+	}
+
+	t.update(func(st *state.State) {
+		rec.Run = st.Run
+		rec.History = history(st.Stages[t.prefix+key])
+		st.Stages[t.prefix+key] = rec
+	})
+}
+
+// secrets returns true if any of the objects is a Secret
+func secrets(resources []string) bool {
+	for _, name := range resources {
+		if strings.HasPrefix(name, "Secret/") {
+			return true
+		}
+	}
+	return false
+}
+
+// history carries the earlier records of a stage into its next
+// record, including the last one if it was applied successfully
+func history(last *state.Record) []*state.Record {
+	if last == nil {
+		return nil
+	}
+	records := last.History
+	if last.Outcome == string(Succeeded) {
+		prev := *last
+		prev.History = nil
+		records = append(records, &prev)
+	}
+	if len(records) > state.Keep {
+		records = records[len(records)-state.Keep:]
+	}
+	return records
+}
+
+// forget removes a deleted stage
+func (t *tracker) forget(key string) {
+	t.update(func(st *state.State) {
+		delete(st.Stages, t.prefix+key)
+	})
+}
+
+func (t *tracker) update(change func(*state.State)) {
+	if t.store == nil || !t.writable {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	change(t.state)
+	if err := t.store.Save(t.state); err != nil {
+		log.Warnf("Couldn't save state: %v", err)
+	}
+}
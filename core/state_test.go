@@ -0,0 +1,181 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/helm"
+	"github.com/monax/compass/kube"
+	"github.com/monax/compass/state"
+	"github.com/monax/compass/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprints(t *testing.T) {
+	stages := newTestResources("db", "api")
+	stages["api"].Depends = []string{"db"}
+
+	before, err := Fingerprints(context.Background(), stages)
+	require.NoError(t, err)
+	assert.Len(t, before, 2)
+
+	// changing a dependency changes its dependants
+	stages["db"].SetInput([]byte("changed"))
+	after, err := Fingerprints(context.Background(), stages)
+	require.NoError(t, err)
+	assert.NotEqual(t, before["db"], after["db"])
+	assert.NotEqual(t, before["api"], after["api"])
+
+	stages["db"].Depends = []string{"api"}
+	_, err = Fingerprints(context.Background(), stages)
+	assert.Error(t, err)
+}
+
+func TestFingerprintSources(t *testing.T) {
+	dir := t.TempDir()
+	writeScroll(t, filepath.Join(dir, "chart", "Chart.yaml"), "apiVersion: v1\nname: local\nversion: 0.1.0\n")
+	writeScroll(t, filepath.Join(dir, "chart", "templates", "config.yaml"), "kind: ConfigMap\n")
+	writeScroll(t, filepath.Join(dir, "config.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n")
+	writeScroll(t, filepath.Join(dir, "base.yaml"), `
+values:
+  namespace: default
+stages:
+  config:
+    kind: kube
+    template: `+filepath.Join(dir, "config.yaml")+`
+`)
+	writeScroll(t, filepath.Join(dir, "scroll.yaml"), `
+values:
+  namespace: default
+stages:
+  chart:
+    kind: helm
+    name: `+filepath.Join(dir, "chart")+`
+    release: local
+  base:
+    kind: workflow
+    scroll: `+filepath.Join(dir, "base.yaml")+`
+`)
+	fingerprints := func() map[string]string {
+		wf := loadScroll(t, filepath.Join(dir, "scroll.yaml"))
+		require.NoError(t, Lint(wf, wf.Values))
+		require.NoError(t, Connect(wf, kube.NewFakeClient(), helm.NewFakeClient(), wf.Values))
+		hashes, err := Fingerprints(context.Background(), wf.Stages)
+		require.NoError(t, err)
+		return hashes
+	}
+	before := fingerprints()
+
+	// what the stages point to changes without their definitions changing
+	writeScroll(t, filepath.Join(dir, "chart", "templates", "config.yaml"), "kind: Secret\n")
+	writeScroll(t, filepath.Join(dir, "config.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: changed\n")
+	after := fingerprints()
+	assert.NotEqual(t, before["chart"], after["chart"])
+	assert.NotEqual(t, before["base"], after["base"])
+	assert.Equal(t, after, fingerprints())
+}
+
+func TestState(t *testing.T) {
+	values := make(util.Values)
+	store := &state.File{Path: filepath.Join(t.TempDir(), "state.json")}
+	applied := func(stg string, stages map[string]*schema.Stage) int {
+		return stages[stg].Resource.(*testResource).applied
+	}
+
+	stages := newTestResources("db", "api")
+	stages["api"].Depends = []string{"db"}
+
+	require.NoError(t, Forward(context.Background(), stages, values, Options{Store: store}))
+	st, err := store.Load()
+	require.NoError(t, err)
+	assert.Len(t, st.Stages, 2)
+	assert.Equal(t, string(Succeeded), st.Stages["db"].Outcome)
+
+	// nothing changed so nothing is applied
+	require.NoError(t, Forward(context.Background(), stages, values, Options{Store: store}))
+	assert.Equal(t, 1, applied("db", stages))
+	assert.Equal(t, 1, applied("api", stages))
+
+	// the dependant is applied again with its dependency
+	stages["db"].SetInput([]byte("changed"))
+	require.NoError(t, Forward(context.Background(), stages, values, Options{Store: store}))
+	assert.Equal(t, 2, applied("db", stages))
+	assert.Equal(t, 2, applied("api", stages))
+
+	// force ignores the state
+	require.NoError(t, Forward(context.Background(), stages, values, Options{Store: store, Force: true}))
+	assert.Equal(t, 3, applied("db", stages))
+
+	// deleted stages are forgotten
+	require.NoError(t, Backward(context.Background(), stages, values, Options{Store: store}))
+	st, err = store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, st.Stages)
+}
+
+func TestResume(t *testing.T) {
+	values := make(util.Values)
+	store := &state.File{Path: filepath.Join(t.TempDir(), "state.json")}
+
+	stages := newTestResources("cache", "db", "api")
+	stages["db"].Resource.(*testResource).err = fmt.Errorf("flaky")
+	stages["api"].Depends = []string{"db"}
+
+	opts := Options{Store: store, Scroll: "scroll.yaml", Resume: true}
+	err := Forward(context.Background(), stages, values, opts)
+	assert.EqualError(t, err, "no previous run to resume")
+
+	opts.Resume = false
+	require.Error(t, Forward(context.Background(), stages, values, opts))
+
+	// the cache stage is satisfied even if it now looks uninstalled
+	stages["cache"].Resource.(*testResource).installed = false
+	stages["db"].Resource.(*testResource).err = nil
+	opts.Resume = true
+	require.NoError(t, Forward(context.Background(), stages, values, opts))
+	assert.Equal(t, 1, stages["cache"].Resource.(*testResource).applied)
+	assert.True(t, installed(stages["db"]))
+	assert.True(t, installed(stages["api"]))
+
+	st, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 2, st.Run)
+	assert.Equal(t, 1, st.Stages["cache"].Run)
+	assert.Equal(t, 2, st.Stages["api"].Run)
+
+	opts.Scroll = "other.yaml"
+	err = Forward(context.Background(), stages, values, opts)
+	assert.EqualError(t, err, "previous run was of scroll.yaml, not other.yaml")
+}
+
+func TestResumeSkipped(t *testing.T) {
+	values := make(util.Values)
+	store := &state.File{Path: filepath.Join(t.TempDir(), "state.json")}
+	stages := newTestResources("db", "api")
+	stages["api"].Depends = []string{"db"}
+	applied := func(stg string) int {
+		return stages[stg].Resource.(*testResource).applied
+	}
+	opts := Options{Store: store, Scroll: "scroll.yaml"}
+	require.NoError(t, Forward(context.Background(), stages, values, opts))
+
+	// api is skipped when the changed db fails
+	stages["db"].SetInput([]byte("changed"))
+	stages["db"].Resource.(*testResource).err = fmt.Errorf("flaky")
+	require.Error(t, Forward(context.Background(), stages, values, opts))
+	assert.Equal(t, 1, applied("api"))
+
+	// so it is not done, even though it succeeded in the first run
+	stages["db"].Resource.(*testResource).err = nil
+	opts.Resume = true
+	require.NoError(t, Forward(context.Background(), stages, values, opts))
+	assert.Equal(t, 2, applied("api"))
+
+	st, err := store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 3, st.Stages["api"].Run)
+}
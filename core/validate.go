@@ -0,0 +1,85 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/monax/compass/core/schema"
+	"github.com/monax/compass/util"
+)
+
+// Validate checks that every dependency exists and that there are no cycles
+func Validate(stages map[string]*schema.Stage) error {
+	keys := make([]string, 0, len(stages))
+	for key := range stages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var unknown []string
+	for _, key := range keys {
+		for _, dep := range stages[key].Depends {
+			if _, ok := stages[dep]; ok {
+				continue
+			}
+			msg := fmt.Sprintf("%s depends on %s", key, dep)
+			if guess := util.Suggest(dep, keys); guess != "" {
+				msg += fmt.Sprintf(" (did you mean %s?)", guess)
+			}
+			unknown = append(unknown, msg)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown dependencies: %s", strings.Join(unknown, ", "))
+	}
+
+	if cycle := findCycle(keys, func(key string) []string { return stages[key].Depends }); cycle != nil {
+		return fmt.Errorf("cycle in dependencies: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// findCycle returns the first cycle found, starting and ending at the same stage,
+// given the stages and the edges from each to those it depends on
+func findCycle(keys []string, edges func(string) []string) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	status := make(map[string]int, len(keys))
+	var path []string
+
+	var visit func(key string) []string
+	visit = func(key string) []string {
+		status[key] = visiting
+		path = append(path, key)
+		for _, dep := range edges(key) {
+			switch status[dep] {
+			case visiting:
+				for i, k := range path {
+					if k == dep {
+						return append(append([]string(nil), path[i:]...), dep)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		status[key] = visited
+		return nil
+	}
+
+	for _, key := range keys {
+		if status[key] == unvisited {
+			if cycle := visit(key); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
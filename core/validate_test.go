@@ -0,0 +1,35 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/monax/compass/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	stages := newTestResources("database", "api", "web")
+	stages["api"].Depends = []string{"databse"}
+	stages["web"].Depends = []string{"api", "cdn"}
+	assert.EqualError(t, Validate(stages),
+		"unknown dependencies: api depends on databse (did you mean database?), web depends on cdn")
+
+	stages["api"].Depends = []string{"database"}
+	stages["database"].Depends = []string{"web"}
+	stages["web"].Depends = []string{"api"}
+	assert.EqualError(t, Validate(stages), "cycle in dependencies: api -> database -> web -> api")
+
+	// every entry point should report the problem rather than hang or panic
+	values := make(util.Values)
+	for _, run := range []func() error{
+		func() error { return Forward(context.Background(), stages, values, Options{}) },
+		func() error { return Backward(context.Background(), stages, values, Options{}) },
+		func() error { return Until(context.Background(), stages, values, Options{}, "web") },
+	} {
+		assert.EqualError(t, run(), "cycle in dependencies: api -> database -> web -> api")
+	}
+
+	stages["database"].Depends = nil
+	assert.NoError(t, Validate(stages))
+}
@@ -1,72 +1,72 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
+	"sync/atomic"
 	"text/template"
+	"time"
 
 	"github.com/Masterminds/sprig"
 	"github.com/monax/compass/core/schema"
 	"github.com/monax/compass/docker"
 	"github.com/monax/compass/helm"
 	"github.com/monax/compass/kube"
+	"github.com/monax/compass/state"
 	"github.com/monax/compass/util"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fastjson"
 )
 
 type Node struct {
-	Lock  *sync.WaitGroup
-	Edges []string
+	Lock   *sync.WaitGroup
+	Edges  []string
+	failed int32
 }
 
 // Depends implements a mapped waitgroup for dependencies
 type Depends map[string]*Node
 
-// Wait on given waitgroups
-func (d Depends) Wait(stages ...string) {
+// Wait on given waitgroups, returning those marked as failed
+func (d Depends) Wait(stages ...string) (failed []string) {
 	for _, key := range stages {
 		d[key].Lock.Wait()
+		if atomic.LoadInt32(&d[key].failed) != 0 {
+			failed = append(failed, key)
+		}
 	}
+	return failed
 }
 
-// Complete given waitgroups
-func (d Depends) Complete(stages ...string) {
+// Fail marks the given nodes so that waiters know not to proceed
+func (d Depends) Fail(stages ...string) {
 	for _, key := range stages {
-		d[key].Lock.Done()
+		atomic.StoreInt32(&d[key].failed, 1)
 	}
 }
 
-func (d Depends) dfs(node string, visited, recStack map[string]bool) bool {
-	if !visited[node] {
-		visited[node] = true
-		recStack[node] = true
-
-		for _, edge := range d[node].Edges {
-			if !visited[edge] && d.dfs(edge, visited, recStack) {
-				return true
-			} else if recStack[edge] {
-				return true
-			}
-		}
-
+// Complete given waitgroups
+func (d Depends) Complete(stages ...string) {
+	for _, key := range stages {
+		d[key].Lock.Done()
 	}
-	recStack[node] = false
-	return false
 }
 
 // IsCyclic returns true if there is a cycle in the graph
 func (d Depends) IsCyclic() bool {
-	visited := make(map[string]bool, len(d))
-	recStack := make(map[string]bool, len(d))
+	keys := make([]string, 0, len(d))
 	for key := range d {
-		if d.dfs(key, visited, recStack) {
-			return true
-		}
+		keys = append(keys, key)
 	}
-	return false
+	return findCycle(keys, func(key string) []string {
+		if node, ok := d[key]; ok {
+			return node.Edges
+		}
+		return nil
+	}) != nil
 }
 
 // NewDepends generates a dependency map
@@ -103,7 +103,37 @@ func NewDepends(stages map[string]*schema.Stage, reverse bool) *Depends {
 
 // Lint all the stages in our pipeline
 func Lint(wf *schema.Workflow, in util.Values) (err error) {
+	if err = wf.OnFailure.Validate(); err != nil {
+		return err
+	} else if err = wf.Render.Validate(); err != nil {
+		return err
+	} else if wf.Concurrency.Stages < 0 || wf.Concurrency.Objects < 0 {
+		return fmt.Errorf("concurrency must not be negative")
+	} else if wf.Helm != 0 && wf.Helm != 2 && wf.Helm != 3 {
+		return fmt.Errorf("helm %d unsupported, use 2 or 3", wf.Helm)
+	} else if err = Validate(wf.Stages); err != nil {
+		return err
+	}
 	for key, stage := range wf.Stages {
+		if err = stage.OnFailure.Validate(); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if err = stage.Render.Validate(); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		} else if stage.Render == "" {
+			stage.Render = wf.Render
+		}
+		if chart, ok := stage.Resource.(*helm.Chart); ok && chart.Helm == 0 {
+			chart.Helm = wf.Helm
+		}
+		if _, err = template.New(key).Funcs(RenderWith(nil)).Parse(stage.When); err != nil {
+			return fmt.Errorf("%s: invalid condition: %v", key, err)
+		}
+		for name, out := range stage.Outputs {
+			if err = out.Validate(stage.Kind, len(stage.Jobs.After)); err != nil {
+				return fmt.Errorf("%s: output %s: %v", key, name, err)
+			}
+		}
 		if err = stage.Lint(key, &in); err != nil {
 			return err
 		}
@@ -111,17 +141,24 @@ func Lint(wf *schema.Workflow, in util.Values) (err error) {
 	return nil
 }
 
-// Connect links all of our stages to their required resources and pre-renders their input
+// Connect links all of our stages to their required resources and pre-renders their input,
+// unless it depends on the outputs of another stage
 func Connect(wf *schema.Workflow, k8s *kube.K8s, tiller *helm.Tiller, v util.Values) error {
-	for _, stg := range wf.Stages {
+	deferred := Deferred(wf.Stages)
+	for key, stg := range wf.Stages {
 		switch stg.Kind {
 		case "kube", "kubernetes":
 			stg.Connect(k8s)
 		case "helm":
 			stg.Connect(tiller)
+		case "workflow":
+			stg.Connect(clients{k8s, tiller})
 		}
 
-		out, err := util.RenderFile(stg.Template, v, RenderWith(k8s))
+		if deferred[key] {
+			continue
+		}
+		out, err := util.RenderFile(stg.Template, scope(v, stg), RenderWith(k8s))
 		if err != nil {
 			return err
 		}
@@ -166,77 +203,344 @@ func RenderWith(k8s *kube.K8s) template.FuncMap {
 	return sprigfn
 }
 
+// Options control how a workflow is executed
+type Options struct {
+	Force     bool             // force install / upgrade / delete
+	DryRun    bool             // report jobs rather than running them
+	OnFailure schema.Policy    // applies to stages without their own policy
+	Halt      <-chan struct{}  // closed to stop scheduling new stages
+	Store     state.Store      // records applied stages, if set
+	Scroll    string           // identifies the workflow in the store
+	Resume    bool             // only run stages which did not succeed last time
+	Parallel  int              // maximum stages running at once, unlimited if zero
+	Funcs     template.FuncMap // used to render templates which depend on outputs
+	Overrides Overrides        // also apply to nested scrolls
+
+	tracker *tracker // of the parent, for nested scrolls
+}
+
+// Overrides are given on the command line, so they take
+// precedence over the settings of nested scrolls
+type Overrides struct {
+	OnFailure schema.Policy
+	Parallel  int
+}
+
+// halted returns an error once no more stages should be started
+func (opts Options) halted(ctx context.Context) error {
+	select {
+	case <-opts.Halt:
+		return fmt.Errorf("interrupted")
+	default:
+		return ctx.Err()
+	}
+}
+
+// policy returns the failure policy for the given stage
+func (opts Options) policy(stg *schema.Stage) schema.Policy {
+	if stg.OnFailure != "" {
+		return stg.OnFailure
+	} else if opts.OnFailure != "" {
+		return opts.OnFailure
+	}
+	return schema.Continue
+}
+
+// executor tracks the progress of a running workflow
+type executor struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	deps     *Depends
+	report   *Report
+	tracker  *tracker
+	slots    chan struct{}   // bounds the number of running stages, if set
+	deferred map[string]bool // stages rendered once their dependencies are applied
+	outputs  outputs
+	input    util.Values
+	opts     Options
+}
+
+func newExecutor(ctx context.Context, stages map[string]*schema.Stage, input util.Values, opts Options, reverse bool) (*executor, error) {
+	if err := Validate(stages); err != nil {
+		return nil, err
+	}
+	deps := NewDepends(stages, reverse)
+
+	tracker := opts.tracker
+	if tracker == nil {
+		var err error
+		if tracker, err = newTracker(opts, !opts.DryRun); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	exec := &executor{
+		ctx:      ctx,
+		cancel:   cancel,
+		deps:     deps,
+		report:   NewReport(),
+		tracker:  tracker,
+		deferred: Deferred(stages),
+		input:    input,
+		opts:     opts,
+	}
+	if opts.Parallel > 0 {
+		exec.slots = make(chan struct{}, opts.Parallel)
+	}
+	return exec, nil
+}
+
+// acquire waits for a free slot, returning an error if we
+// are halted or cancelled in the meantime
+func (exec *executor) acquire() error {
+	if exec.slots == nil {
+		return exec.opts.halted(exec.ctx)
+	}
+	select {
+	case exec.slots <- struct{}{}:
+	case <-exec.ctx.Done():
+		return exec.ctx.Err()
+	}
+	if err := exec.opts.halted(exec.ctx); err != nil {
+		exec.release()
+		return err
+	}
+	return nil
+}
+
+// release frees the slot taken by acquire
+func (exec *executor) release() {
+	if exec.slots != nil {
+		<-exec.slots
+	}
+}
+
 // Backward deletes each stage in reverse order
-func Backward(stages map[string]*schema.Stage, input util.Values, force bool) {
+func Backward(ctx context.Context, stages map[string]*schema.Stage, input util.Values, opts Options) error {
 	var wg sync.WaitGroup
-	defer wg.Wait()
+	exec, err := newExecutor(ctx, stages, input, opts, true)
+	if err != nil {
+		return err
+	}
+	defer exec.cancel()
 
 	wg.Add(len(stages))
-	deps := NewDepends(stages, true)
-
 	for key, stage := range stages {
 		go func(this *schema.Stage, key string) {
-			defer deps.Complete(this.Depends...) // signal anything that depends on this
-			defer wg.Done()                      // main thread can continue
-			deps.Wait(key)                       // wait for dependants to delete first
-
-			Destroy(this, log.WithField("kind", stage.Kind), key, input, force)
+			defer exec.deps.Complete(this.Depends...) // signal anything that depends on this
+			defer wg.Done()                           // main thread can continue
+			exec.destroy(this, key)
 		}(stage, key)
 	}
+
+	wg.Wait()
+	return summarize(exec.report)
 }
 
 // Forward processes each stage in the pipeline
-func Forward(stages map[string]*schema.Stage, input util.Values, force bool) error {
+func Forward(ctx context.Context, stages map[string]*schema.Stage, input util.Values, opts Options) error {
 	var wg sync.WaitGroup
-
-	wg.Add(len(stages))
-	deps := NewDepends(stages, false)
-	if deps.IsCyclic() {
-		return fmt.Errorf("cycle in dependencies")
+	exec, err := newExecutor(ctx, stages, input, opts, false)
+	if err != nil {
+		return err
 	}
+	defer exec.cancel()
 
-	defer wg.Wait()
 	log.Infoln("Starting workflow...")
+	wg.Add(len(stages))
 	for key, stage := range stages {
 		go func(this *schema.Stage, key string) {
-			defer deps.Complete(key)   // indicate thread finished
-			defer wg.Done()            // main thread can continue
-			deps.Wait(this.Depends...) // wait for dependencies
-
-			Create(this, log.WithField("kind", this.Kind), key, input, force)
+			defer exec.deps.Complete(key) // indicate thread finished
+			defer wg.Done()               // main thread can continue
+			exec.create(this, key)
 		}(stage, key)
 	}
 
-	return nil
+	wg.Wait()
+	return summarize(exec.report)
 }
 
-// Until creates single resource and dependencies
-func Until(stages map[string]*schema.Stage, input util.Values, force bool, target string) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
+// Until creates the target stages and everything they depend on
+func Until(ctx context.Context, stages map[string]*schema.Stage, input util.Values, opts Options, targets ...string) error {
+	if err := Validate(stages); err != nil {
+		return err
+	}
+	sub, err := Closure(stages, targets...)
+	if err != nil {
+		return err
+	}
+	return Forward(ctx, sub, input, opts)
+}
 
-	deps := NewDepends(stages, false)
+// Closure returns the target stages along with their transitive dependencies
+func Closure(stages map[string]*schema.Stage, targets ...string) (map[string]*schema.Stage, error) {
+	sub := make(map[string]*schema.Stage)
+	var visit func(key, from string) error
+	visit = func(key, from string) error {
+		if _, ok := sub[key]; ok {
+			return nil
+		}
+		stg, ok := stages[key]
+		if !ok && from == "" {
+			return fmt.Errorf("%s does not exist", key)
+		} else if !ok {
+			return fmt.Errorf("dependency %s of %s does not exist", key, from)
+		}
+		sub[key] = stg
+		for _, dep := range stg.Depends {
+			if err := visit(dep, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
-	if _, ok := stages[target]; !ok {
-		log.Fatalf("%s does not exist", target)
+	for _, target := range targets {
+		if err := visit(target, ""); err != nil {
+			return nil, err
+		}
 	}
+	return sub, nil
+}
 
-	wg.Add(len(stages[target].Depends) + 1)
-	go func(this *schema.Stage, key string) {
-		defer deps.Complete(key)
-		defer wg.Done()
-		deps.Wait(this.Depends...)
+// create waits for the dependencies of a stage before installing it,
+// skipping the stage entirely if any of them did not succeed
+func (exec *executor) create(stg *schema.Stage, key string) {
+	logger := log.WithField("kind", stg.Kind)
+	if blocked := exec.deps.Wait(stg.Depends...); len(blocked) > 0 {
+		logger.Warnf("Skipping: %s", key)
+		exec.deps.Fail(key)
+		exec.report.Skip(key, blocked)
+		return
+	} else if err := exec.acquire(); err != nil {
+		logger.Warnf("Skipping: %s", key)
+		exec.deps.Fail(key)
+		exec.report.Add(key, Skipped, err)
+		return
+	}
+	defer exec.release()
+
+	values := scope(exec.outputs.merge(exec.input), stg)
+	var (
+		out    Outcome
+		stdout []string
+		err    error
+	)
+	if exec.deferred[key] {
+		var rendered []byte
+		if rendered, err = util.RenderFile(stg.Template, values, exec.opts.Funcs); err != nil {
+			logger.Errorf("Failed to render %s: %v", key, err)
+			out = Failed
+		} else {
+			stg.SetInput(rendered)
+		}
+	}
 
-		Create(this, log.WithField("kind", this.Kind), key, input, force)
-	}(stages[target], target)
+	if err == nil {
+		exec.tracker.hash(exec.ctx, key, stg)
 
-	for _, dep := range stages[target].Depends {
-		go func(this *schema.Stage, key string) {
-			defer deps.Complete(key)
-			defer wg.Done()
-			deps.Wait(this.Depends...)
+		if exec.opts.Resume {
+			if rec := exec.tracker.resumable(key); rec != nil && exec.reuse(stg, key, rec) {
+				logger.Infof("Resuming: %s (applied in run %d)", key, rec.Run)
+				exec.report.Add(key, Unchanged, nil)
+				return
+			}
+		}
+
+		if rec := exec.tracker.unchanged(key); rec != nil && !exec.opts.Force {
+			if installed, _ := stg.Status(exec.ctx); installed && exec.reuse(stg, key, rec) {
+				logger.Infof("Unchanged: %s (applied %s)", key, rec.Applied.Format(time.RFC3339))
+				exec.report.Add(key, Unchanged, nil)
+				return
+			}
+		}
+
+		if n, ok := stg.Resource.(*Nested); ok {
+			n.inherit(exec.opts, exec.tracker.nested(key))
+		}
+		out, stdout, err = install(exec.ctx, stg, logger, key, values, exec.opts)
+	}
+	var captured map[string]string
+	if out != Failed && len(stg.Outputs) > 0 {
+		if captured, err = capture(exec.ctx, stg, stdout, nil, exec.opts.DryRun); err == nil {
+			exec.outputs.add(key, captured)
+		} else if out == Ignored {
+			// nothing was applied so the outputs may not exist
+			logger.Warnf("Couldn't read outputs of %s: %v", key, err)
+			err = nil
+		} else {
+			logger.Errorf("Failed to read outputs of %s: %v", key, err)
+			out = Failed
+		}
+	}
+
+	if err != nil {
+		exec.deps.Fail(key)
+		switch exec.opts.policy(stg) {
+		case schema.Abort:
+			logger.Warnf("Aborting workflow")
+			exec.cancel()
+		case schema.Rollback:
+			if rerr := stg.Rollback(exec.ctx); rerr != nil {
+				err = fmt.Errorf("%v (rollback failed: %v)", err, rerr)
+			} else {
+				err = fmt.Errorf("%v (rolled back)", err)
+			}
+		}
+	}
+	exec.tracker.record(key, stg, out, captured)
+	exec.report.Add(key, out, err)
+}
+
+// reuse reads the outputs of a stage which is not being applied again,
+// returning false if they are not all available
+func (exec *executor) reuse(stg *schema.Stage, key string, rec *state.Record) bool {
+	if len(stg.Outputs) == 0 {
+		return true
+	}
+	captured, err := capture(exec.ctx, stg, nil, rec.Outputs, exec.opts.DryRun)
+	if err != nil {
+		log.WithField("kind", stg.Kind).Warnf("Applying %s again, couldn't read outputs: %v", key, err)
+		return false
+	}
+	exec.outputs.add(key, captured)
+	return true
+}
+
+// destroy waits for the dependants of a stage to be deleted before deleting it
+func (exec *executor) destroy(stg *schema.Stage, key string) {
+	// wait for dependants to delete first
+	if blocked := exec.deps.Wait(key); len(blocked) > 0 {
+		exec.deps.Fail(stg.Depends...)
+		exec.report.Add(key, Skipped, fmt.Errorf("dependants were not deleted"))
+		return
+	} else if err := exec.acquire(); err != nil {
+		exec.deps.Fail(stg.Depends...)
+		exec.report.Add(key, Skipped, err)
+		return
+	}
+	defer exec.release()
 
-			Create(this, log.WithField("kind", this.Kind), key, input, force)
-		}(stages[dep], dep)
+	if n, ok := stg.Resource.(*Nested); ok {
+		n.inherit(exec.opts, exec.tracker.nested(key))
 	}
+	out, err := Destroy(exec.ctx, stg, log.WithField("kind", stg.Kind), key, scope(exec.input, stg), exec.opts)
+	if err != nil {
+		exec.deps.Fail(stg.Depends...)
+		if exec.opts.policy(stg) == schema.Abort {
+			exec.cancel()
+		}
+	} else if out == Succeeded {
+		exec.tracker.forget(key)
+	}
+	exec.report.Add(key, out, err)
+}
+
+func summarize(report *Report) error {
+	if err := report.Err(); err != nil {
+		return err
+	}
+	log.Infof("Workflow complete:\n%s", report)
+	return nil
 }
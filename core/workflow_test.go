@@ -1,12 +1,20 @@
 package core
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/monax/compass/core/schema"
 	"github.com/monax/compass/helm"
 	"github.com/monax/compass/util"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -19,6 +27,13 @@ func TestLinter(t *testing.T) {
 	chart.Resource.(*helm.Chart).Namespace = ""
 	Lint(wf, util.Values{"namespace": "somewhere-else"})
 	assert.Equal(t, "somewhere-else", wf.Stages["test"].Resource.(*helm.Chart).Namespace)
+
+	// the version of helm cascades unless the stage sets its own
+	wf.Helm = 3
+	require.NoError(t, Lint(wf, util.Values{}))
+	assert.Equal(t, 3, chart.Resource.(*helm.Chart).Helm)
+	wf.Helm = 4
+	assert.Error(t, Lint(wf, util.Values{}))
 }
 
 var testData = `
@@ -77,7 +92,7 @@ func TestRun(t *testing.T) {
 			t.Parallel()
 			workflow := newTestWorkflow("test1", "test2")
 			workflow.Stages["test2"].Depends = []string{"test1"}
-			err := Forward(workflow.Stages, values, false)
+			err := Forward(context.Background(), workflow.Stages, values, Options{})
 			assert.NoError(t, err)
 		})
 		t.Run("AdvancedRun", func(t *testing.T) {
@@ -85,7 +100,7 @@ func TestRun(t *testing.T) {
 			workflow := newTestWorkflow("test1", "test2", "test3", "test4")
 			workflow.Stages["test2"].Depends = []string{"test1"}
 			workflow.Stages["test3"].Depends = []string{"test2"}
-			err := Forward(workflow.Stages, values, false)
+			err := Forward(context.Background(), workflow.Stages, values, Options{})
 			assert.NoError(t, err)
 		})
 		t.Run("DepCycle", func(t *testing.T) {
@@ -94,8 +109,249 @@ func TestRun(t *testing.T) {
 			workflow.Stages["test1"].Depends = []string{"test2"}
 			workflow.Stages["test2"].Depends = []string{"test3"}
 			workflow.Stages["test3"].Depends = []string{"test1"}
-			err := Forward(workflow.Stages, values, false)
+			err := Forward(context.Background(), workflow.Stages, values, Options{})
 			assert.Error(t, err)
 		})
 	})
 }
+
+// testResource records how it was used without talking to a cluster
+type testResource struct {
+	err        error
+	installed  bool
+	rolledBack bool
+	applied    int
+	input      []byte
+	gauge      *gauge
+}
+
+// gauge records the most resources installing at once
+type gauge struct {
+	active, peak int32
+}
+
+func (g *gauge) measure() {
+	active := atomic.AddInt32(&g.active, 1)
+	for peak := atomic.LoadInt32(&g.peak); active > peak; peak = atomic.LoadInt32(&g.peak) {
+		if atomic.CompareAndSwapInt32(&g.peak, peak, active) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	atomic.AddInt32(&g.active, -1)
+}
+
+func (r *testResource) Lint(string, *util.Values) error      { return nil }
+func (r *testResource) Status(context.Context) (bool, error) { return r.installed, nil }
+func (r *testResource) Connect(interface{})                  {}
+func (r *testResource) SetInput(in []byte)                   { r.input = in }
+func (r *testResource) GetInput() []byte                     { return r.input }
+
+func (r *testResource) InstallOrUpgrade(context.Context) error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.gauge != nil {
+		r.gauge.measure()
+	}
+	r.installed = true
+	r.applied++
+	return nil
+}
+
+func (r *testResource) Rollback(context.Context) error {
+	r.rolledBack = true
+	return nil
+}
+
+func (r *testResource) Diff(context.Context) (string, error) {
+	return "", nil
+}
+
+func (r *testResource) Delete(context.Context) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.installed = false
+	return nil
+}
+
+func newTestResources(names ...string) map[string]*schema.Stage {
+	stages := make(map[string]*schema.Stage, len(names))
+	for _, n := range names {
+		stages[n] = &schema.Stage{
+			Actions:  schema.Actions{Kind: "test"},
+			Resource: &testResource{},
+		}
+	}
+	return stages
+}
+
+func installed(stg *schema.Stage) bool {
+	return stg.Resource.(*testResource).installed
+}
+
+func TestFailures(t *testing.T) {
+	values := make(util.Values)
+
+	t.Run("Forward", func(t *testing.T) {
+		stages := newTestResources("db", "api", "web", "cache")
+		stages["db"].Resource.(*testResource).err = fmt.Errorf("broken")
+		stages["api"].Depends = []string{"db"}
+		stages["web"].Depends = []string{"api"}
+
+		err := Forward(context.Background(), stages, values, Options{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "1 failed, 2 skipped")
+		assert.Regexp(t, "db +failed: broken", err.Error())
+		assert.Regexp(t, "web +skipped: blocked by api", err.Error())
+		assert.False(t, installed(stages["api"]))
+		assert.False(t, installed(stages["web"]))
+		assert.True(t, installed(stages["cache"]))
+	})
+
+	t.Run("Backward", func(t *testing.T) {
+		stages := newTestResources("db", "api", "cache")
+		stages["api"].Depends = []string{"db"}
+		for _, stg := range stages {
+			stg.Resource.(*testResource).installed = true
+		}
+		stages["api"].Resource.(*testResource).err = fmt.Errorf("broken")
+
+		err := Backward(context.Background(), stages, values, Options{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "1 failed, 1 skipped")
+		assert.True(t, installed(stages["db"]))
+		assert.False(t, installed(stages["cache"]))
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		stages := newTestResources("db", "slow")
+		stages["db"].Resource.(*testResource).err = fmt.Errorf("broken")
+		stages["db"].OnFailure = schema.Abort
+		stages["slow"].Jobs.Before = []string{"sleep 10"}
+
+		start := time.Now()
+		err := Forward(context.Background(), stages, values, Options{})
+		require.Error(t, err)
+		assert.True(t, time.Since(start) < 5*time.Second)
+		assert.False(t, installed(stages["slow"]))
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		stages := newTestResources("db", "api")
+		stages["db"].Resource.(*testResource).err = fmt.Errorf("broken")
+
+		err := Forward(context.Background(), stages, values, Options{OnFailure: schema.Rollback})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "broken (rolled back)")
+		assert.True(t, stages["db"].Resource.(*testResource).rolledBack)
+		assert.False(t, stages["api"].Resource.(*testResource).rolledBack)
+		assert.True(t, installed(stages["api"]))
+	})
+
+	t.Run("RollbackBefore", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "templates"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte("apiVersion: v1\nname: local\nversion: 0.1.0\n"), 0644))
+		stages := map[string]*schema.Stage{"chart": newTestChart()}
+		stages["chart"].Resource.(*helm.Chart).Name = dir
+		require.NoError(t, Forward(context.Background(), stages, values, Options{}))
+
+		// the release was there before the next run so it is kept
+		tiller := stages["chart"].Resource.(*helm.Chart).Tiller
+		stages["chart"] = newTestChart()
+		stages["chart"].Resource.(*helm.Chart).Name = dir
+		stages["chart"].Connect(tiller)
+		stages["chart"].Jobs.Before = []string{"false"}
+		err := Forward(context.Background(), stages, values, Options{OnFailure: schema.Rollback})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "(rolled back)")
+		exists, err := stages["chart"].Status(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+}
+
+func TestInterrupt(t *testing.T) {
+	stages := newTestResources("db", "api")
+	stages["api"].Depends = []string{"db"}
+
+	halt := make(chan struct{})
+	close(halt)
+	err := Forward(context.Background(), stages, make(util.Values), Options{Halt: halt})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "0 failed, 2 skipped")
+	assert.False(t, installed(stages["db"]))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Backward(ctx, stages, make(util.Values), Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "context canceled")
+}
+
+func TestUntil(t *testing.T) {
+	values := make(util.Values)
+	stages := newTestResources("db", "cache", "api", "web", "docs")
+	stages["api"].Depends = []string{"db", "cache"}
+	stages["web"].Depends = []string{"api"}
+
+	err := Until(context.Background(), stages, values, Options{}, "web", "docs")
+	require.NoError(t, err)
+	for _, key := range []string{"db", "cache", "api", "web", "docs"} {
+		assert.True(t, installed(stages[key]), key)
+	}
+
+	stages = newTestResources("db", "cache", "api", "web")
+	stages["api"].Depends = []string{"db"}
+	stages["web"].Depends = []string{"api"}
+	require.NoError(t, Until(context.Background(), stages, values, Options{}, "api"))
+	assert.True(t, installed(stages["db"]))
+	assert.True(t, installed(stages["api"]))
+	assert.False(t, installed(stages["web"]))
+	assert.False(t, installed(stages["cache"]))
+
+	assert.EqualError(t, Until(context.Background(), stages, values, Options{}, "nope"), "nope does not exist")
+	stages["db"].Depends = []string{"missing"}
+	assert.EqualError(t, Until(context.Background(), stages, values, Options{}, "web"), "unknown dependencies: db depends on missing")
+}
+
+func TestParallel(t *testing.T) {
+	values := make(util.Values)
+	for _, limit := range []int{1, 2} {
+		g := new(gauge)
+		stages := newTestResources("a", "b", "c", "d", "e")
+		for _, stg := range stages {
+			stg.Resource.(*testResource).gauge = g
+		}
+
+		require.NoError(t, Forward(context.Background(), stages, values, Options{Parallel: limit}))
+		assert.True(t, atomic.LoadInt32(&g.peak) <= int32(limit), "ran %d stages at once", g.peak)
+	}
+}
+
+func TestWhen(t *testing.T) {
+	stages := newTestResources("db", "monitoring", "api")
+	stages["monitoring"].When = `{{ and .monitor (ne .env "dev") }}`
+	stages["api"].Depends = []string{"monitoring"}
+	values := util.Values{"monitor": true, "env": "dev"}
+
+	// skipped stages still satisfy their dependants
+	require.NoError(t, Forward(context.Background(), stages, values, Options{}))
+	assert.False(t, installed(stages["monitoring"]))
+	assert.True(t, installed(stages["api"]))
+
+	values["env"] = "prod"
+	require.NoError(t, Forward(context.Background(), stages, values, Options{}))
+	assert.True(t, installed(stages["monitoring"]))
+
+	// the condition must evaluate
+	stages["monitoring"].When = `{{ gt .env 1 }}`
+	assert.Error(t, Forward(context.Background(), stages, values, Options{}))
+
+	wf := schema.NewWorkflow()
+	wf.Stages = stages
+	stages["monitoring"].When = `{{ and .monitor`
+	assert.Error(t, Lint(wf, values))
+}
@@ -1,10 +1,14 @@
 package helm
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/monax/compass/kube"
 	"github.com/monax/compass/util"
@@ -17,17 +21,25 @@ import (
 	"k8s.io/helm/pkg/helm/helmpath"
 	"k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/releaseutil"
+	storageerrors "k8s.io/helm/pkg/storage/errors"
 )
 
-// Tiller represents a helm client and open connection to tiller
+// Tiller represents a helm client, the connection to tiller is
+// only opened once it is needed by a helm 2 release
 type Tiller struct {
-	client helm.Interface
-	envset helm_env.EnvSettings
-	tiller chan struct{}
-	logger *log.Entry
+	DryRun    bool `json:"-"` // simulate changes and print the rendered manifests
+	client    helm.Interface
+	envset    helm_env.EnvSettings
+	tiller    chan struct{}
+	dial      func() chan struct{} // forwards a local port to tiller
+	once      sync.Once
+	k8s       *kube.K8s
+	namespace string // where tiller records its releases
+	logger    *log.Entry
 }
 
-// NewClient creates a new connection to tiller
+// NewClient creates a new helm client, to connect to tiller on demand
 func NewClient(k8s *kube.K8s, conf, namespace, remote string) (*Tiller, error) {
 	listener, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
@@ -50,16 +62,33 @@ func NewClient(k8s *kube.K8s, conf, namespace, remote string) (*Tiller, error) {
 	return &Tiller{
 		client: hl,
 		envset: settings,
-		tiller: k8s.ForwardPod("tiller", namespace, localPort, remote),
+		dial: func() chan struct{} {
+			return k8s.ForwardPod("tiller", namespace, localPort, remote)
+		},
+		k8s:       k8s,
+		namespace: namespace,
 		logger: log.WithFields(log.Fields{
 			"kind": "helm",
 		}),
 	}, nil
 }
 
-// Close gracefully exits the connection to tiller
+// tillerClient opens the connection to tiller on first use
+func (hl *Tiller) tillerClient() helm.Interface {
+	hl.once.Do(func() {
+		if hl.dial != nil {
+			hl.tiller = hl.dial()
+		}
+	})
+	return hl.client
+}
+
+// Close gracefully exits the connection to tiller, if it was opened
 func (hl *Tiller) Close() {
-	close(hl.tiller)
+	hl.once.Do(func() {})
+	if hl.tiller != nil {
+		close(hl.tiller)
+	}
 }
 
 // Chart comprises the helm release
@@ -69,7 +98,12 @@ type Chart struct {
 	Release   string `yaml:"release"`   // release name
 	Namespace string `yaml:"namespace"` // namespace
 	Timeout   int64  `yaml:"timeout"`   // install / upgrade wait time
+	Helm      int    `yaml:"helm"`      // major version of helm, 2 (default) or 3
+	Atomic    bool   `yaml:"atomic"`    // roll back a failed upgrade
 	Object    []byte
+	previous  int32  // revision before the last install / upgrade
+	released  string // chart version of the last install / upgrade
+	applied   bool   // whether the last install / upgrade reached helm
 	*Tiller
 }
 
@@ -86,9 +120,30 @@ func (c *Chart) Lint(key string, in *util.Values) error {
 	if c.Name == "" {
 		return fmt.Errorf("chart name required in the format repo/app")
 	}
+	if c.Helm != 0 && c.Helm != 2 && c.Helm != 3 {
+		return fmt.Errorf("helm %d for %s unsupported, use 2 or 3", c.Helm, key)
+	}
 	return nil
 }
 
+// releaser performs the releases of a chart
+type releaser interface {
+	content(c *Chart) (*release.Release, error) // latest revision, nil if there is none
+	history(c *Chart) ([]*release.Release, error)
+	install(ctx context.Context, c *Chart, req *chart.Chart, dryRun bool) (*release.Release, error)
+	upgrade(ctx context.Context, c *Chart, req *chart.Chart, dryRun bool) (*release.Release, error)
+	rollback(ctx context.Context, c *Chart, revision int32) error
+	delete(ctx context.Context, c *Chart) error
+}
+
+// releases returns the backend for the version of helm used by the chart
+func (c *Chart) releases() releaser {
+	if c.Helm == 3 {
+		return helm3{c.Tiller}
+	}
+	return helm2{c.Tiller}
+}
+
 // SetInput adds the templated values file
 func (c *Chart) SetInput(obj []byte) {
 	c.Object = obj
@@ -132,87 +187,367 @@ func (c *Chart) Download() (*chart.Chart, error) {
 	return chartutil.Load(chart)
 }
 
-// Status returns the status of a release
-// true if exists, else false
-func (c *Chart) Status() (bool, error) {
-	rs, err := c.client.ReleaseStatus(c.Release)
-	if err != nil || rs == nil {
-		// we can probably be smarter about this
-		// but typically helm returns an error if
-		// the release doesn't exist
-		return false, err
-	}
+// Status returns true if the release exists, see ReleaseStatus for its state,
+// it never changes the release as plan and diff rely on it
+func (c *Chart) Status(ctx context.Context) (bool, error) {
+	st, err := c.ReleaseStatus(ctx)
+	return st.Installed(), err
+}
 
-	// exists; check what state it's in
-	statusCode := rs.GetInfo().Status.Code
+// revision returns the current version of the release, zero if none
+func (c *Chart) revision() int32 {
+	rel, err := c.releases().content(c)
+	if err != nil || rel == nil {
+		return 0
+	}
+	return rel.GetVersion()
+}
 
-	if statusCode == release.Status_PENDING_INSTALL {
-		return false, c.Delete()
-	} else if statusCode == release.Status_FAILED {
-		rh, err := c.client.ReleaseHistory(c.Release)
-		if err != nil {
-			return false, err
-		}
-		// helm won't let us upgrade if the first release failed
-		if releases := rh.GetReleases(); len(releases) <= 1 {
-			return false, c.Delete()
-		}
+// wait runs the call in the background, returning early if the context
+// is done - tiller will be left to finish or fail once the tunnel closes
+func wait(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// TODO: check other statuses
-	return true, nil
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // InstallOrUpgrade deploys a helm chart
-func (c *Chart) InstallOrUpgrade() error {
-	exists, _ := c.Status()
+func (c *Chart) InstallOrUpgrade(ctx context.Context) error {
+	c.applied = false
+	st, err := c.ready(ctx)
+	if err != nil {
+		return err
+	}
+	c.previous = st.Revision
 	reqChart, err := c.Download()
 	if err != nil {
 		return err
 	}
 
-	c.logger.Infof("Releasing: %s (%s)", c.Release, reqChart.GetMetadata().GetVersion())
-	if !exists {
-		return c.Install(reqChart)
+	c.released = reqChart.GetMetadata().GetVersion()
+	c.logger.Infof("Releasing: %s (%s)", c.Release, c.released)
+	c.applied = true
+	if !st.Installed() {
+		return c.Install(ctx, reqChart)
 	}
-	return c.Upgrade(reqChart)
+	return c.Upgrade(ctx, reqChart)
 }
 
-// Install tells tiller to install a helm chart
-func (c *Chart) Install(req *chart.Chart) error {
-	_, err := c.client.InstallReleaseFromChart(
-		req,
-		c.Namespace,
-		helm.ReleaseName(c.Release),
-		helm.InstallWait(true),
-		helm.InstallTimeout(c.Timeout),
-		helm.ValueOverrides(c.Object),
-		helm.InstallDryRun(false),
-	)
+// Install releases a helm chart for the first time
+func (c *Chart) Install(ctx context.Context, req *chart.Chart) error {
+	rel, err := c.releases().install(ctx, c, req, c.DryRun)
+	if err == nil && c.DryRun {
+		fmt.Println(rel.GetManifest())
+	}
 	return err
 }
 
-// Upgrade tells tiller to upgrade a helm chart
-func (c *Chart) Upgrade(req *chart.Chart) error {
-	_, err := c.client.UpdateReleaseFromChart(
-		c.Release,
-		req,
-		helm.UpgradeTimeout(c.Timeout),
-		helm.UpdateValueOverrides(c.Object),
-		helm.UpgradeDryRun(false),
-	)
+// Upgrade releases a new revision of a helm chart, if it fails
+// and the chart is atomic we return to the last good revision
+func (c *Chart) Upgrade(ctx context.Context, req *chart.Chart) error {
+	rel, err := c.releases().upgrade(ctx, c, req, c.DryRun)
+	if err == nil && c.DryRun {
+		fmt.Println(rel.GetManifest())
+		return nil
+	} else if err == nil && rel.GetInfo().GetStatus().GetCode() == release.Status_FAILED {
+		err = fmt.Errorf("release %s failed: %s", c.Release, rel.GetInfo().GetDescription())
+	}
+	if err != nil && c.Atomic {
+		return c.restore(ctx, err)
+	}
 	return err
 }
 
-// Delete tells tiller to destroy a release
-func (c *Chart) Delete() error {
-	_, err := c.client.DeleteRelease(
-		c.Release,
-		helm.DeletePurge(true),
-		helm.DeleteTimeout(60),
-		helm.DeleteDryRun(false),
-	)
-	return err
+// restore rolls back to the last revision which deployed successfully,
+// reporting the original failure along with the result of the rollback
+func (c *Chart) restore(ctx context.Context, failure error) error {
+	releases, err := c.releases().history(c)
+	if err != nil {
+		return fmt.Errorf("%v, couldn't read history to roll back: %v", failure, err)
+	}
+	revision := lastDeployed(releases, math.MaxInt32)
+	if revision == 0 {
+		return fmt.Errorf("%v, no successful revision to roll back to", failure)
+	}
+
+	c.logger.Warnf("Rolling back: %s (failed upgrade -> %d)", c.Release, revision)
+	if err = c.releases().rollback(ctx, c, revision); err != nil {
+		return fmt.Errorf("%v, rollback to %d failed: %v", failure, revision, err)
+	}
+	rel, err := c.releases().content(c)
+	if err != nil {
+		return fmt.Errorf("%v, rollback to %d unconfirmed: %v", failure, revision, err)
+	} else if code := rel.GetInfo().GetStatus().GetCode(); code != release.Status_DEPLOYED {
+		return fmt.Errorf("%v, rollback to %d ended as %s", failure, revision, code)
+	}
+
+	// the release is as it was, so there is nothing left to revert
+	c.previous = rel.GetVersion()
+	return fmt.Errorf("%v, rolled back to %d", failure, revision)
+}
+
+// lastDeployed returns the latest revision before the given one
+// which was deployed successfully, zero if there is none
+func lastDeployed(releases []*release.Release, before int32) (revision int32) {
+	for _, rel := range releases {
+		switch rel.GetInfo().GetStatus().GetCode() {
+		case release.Status_DEPLOYED, release.Status_SUPERSEDED:
+			if rel.GetVersion() > revision && rel.GetVersion() < before {
+				revision = rel.GetVersion()
+			}
+		}
+	}
+	return revision
+}
+
+// Revision describes a single release of a chart
+type Revision struct {
+	Version     int32     `json:"revision"`
+	Updated     time.Time `json:"updated"`
+	Status      string    `json:"status"`
+	Chart       string    `json:"chart"` // chart version
+	Description string    `json:"description"`
+}
+
+// History lists each revision of the release, oldest first
+func (c *Chart) History(ctx context.Context) ([]Revision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	releases, err := c.releases().history(c)
+	if err != nil {
+		return nil, err
+	}
+	releaseutil.SortByRevision(releases)
+
+	revisions := make([]Revision, len(releases))
+	for i, rel := range releases {
+		revisions[i] = Revision{
+			Version:     rel.GetVersion(),
+			Updated:     stamp(rel.GetInfo().GetLastDeployed()),
+			Status:      statuses[rel.GetInfo().GetStatus().GetCode()],
+			Chart:       rel.GetChart().GetMetadata().GetVersion(),
+			Description: rel.GetInfo().GetDescription(),
+		}
+	}
+	return revisions, nil
+}
+
+// RollbackTo reverts the release to the given revision or, if zero,
+// to the last which deployed successfully before the current one
+func (c *Chart) RollbackTo(ctx context.Context, revision int32) error {
+	releases, err := c.releases().history(c)
+	if err != nil {
+		return err
+	} else if len(releases) == 0 {
+		return fmt.Errorf("release: %q not found", c.Release)
+	}
+
+	var current int32
+	for _, rel := range releases {
+		if rel.GetVersion() > current {
+			current = rel.GetVersion()
+		}
+	}
+	if revision == 0 {
+		if revision = lastDeployed(releases, current); revision == 0 {
+			return fmt.Errorf("no earlier revision of %s to roll back to", c.Release)
+		}
+	}
+
+	c.logger.Infof("Rolling back: %s (%d -> %d)", c.Release, current, revision)
+	return c.releases().rollback(ctx, c, revision)
+}
+
+// Released returns the chart version of the last install / upgrade
+func (c *Chart) Released() string {
+	return c.released
+}
+
+// Lookup reads the notes, computed values, manifest or version of the
+// deployed release, a path selects a single entry from the values
+func (c *Chart) Lookup(ctx context.Context, field, path string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	rel, err := c.releases().content(c)
+	if err != nil {
+		return "", err
+	} else if rel == nil {
+		return "", fmt.Errorf("release %s not found", c.Release)
+	}
+
+	switch field {
+	case "notes":
+		return rel.GetInfo().GetStatus().GetNotes(), nil
+	case "manifest":
+		return rel.GetManifest(), nil
+	case "version":
+		return fmt.Sprintf("%d", rel.GetVersion()), nil
+	case "values":
+		values, err := chartutil.CoalesceValues(rel.GetChart(), rel.GetConfig())
+		if err != nil {
+			return "", err
+		}
+		if path == "" {
+			return values.YAML()
+		}
+		value, err := values.PathValue(path)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v", value), nil
+	}
+	return "", fmt.Errorf("release field '%s' unknown", field)
+}
+
+// Rollback reverts the release to its state before the last install / upgrade
+func (c *Chart) Rollback(ctx context.Context) error {
+	if !c.applied {
+		// failed before anything was released
+		return nil
+	}
+	current := c.revision()
+	if current == c.previous {
+		// nothing was released
+		return nil
+	} else if c.previous == 0 {
+		c.logger.Infof("Purging: %s", c.Release)
+		return c.Delete(ctx)
+	}
+
+	c.logger.Infof("Rolling back: %s (%d -> %d)", c.Release, current, c.previous)
+	return c.releases().rollback(ctx, c, c.previous)
+}
+
+// Diff compares the deployed manifest and values with those
+// of a dry-run install or upgrade of the requested chart
+func (c *Chart) Diff(ctx context.Context) (string, error) {
+	live, err := c.releases().content(c)
+	if err != nil {
+		return "", err
+	}
+	liveManifest := live.GetManifest()
+	liveValues := live.GetConfig().GetRaw()
+
+	reqChart, err := c.Download()
+	if err != nil {
+		return "", err
+	}
+
+	var pending *release.Release
+	if live == nil {
+		pending, err = c.releases().install(ctx, c, reqChart, true)
+	} else {
+		pending, err = c.releases().upgrade(ctx, c, reqChart, true)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	values, err := util.Diff(liveValues, pending.GetConfig().GetRaw(), c.Release+"/values (deployed)", c.Release+"/values (pending)")
+	if err != nil {
+		return "", err
+	}
+	manifest, err := util.Diff(liveManifest, pending.GetManifest(), c.Release+"/manifest (deployed)", c.Release+"/manifest (pending)")
+	return values + manifest, err
+}
+
+// Delete destroys a release along with its history
+func (c *Chart) Delete(ctx context.Context) error {
+	return c.releases().delete(ctx, c)
+}
+
+// helm2 releases charts through tiller
+type helm2 struct {
+	*Tiller
+}
+
+func (h helm2) content(c *Chart) (*release.Release, error) {
+	rc, err := h.tillerClient().ReleaseContent(c.Release)
+	// tiller only tells us the release is missing in the message
+	if err != nil && strings.Contains(err.Error(), storageerrors.ErrReleaseNotFound(c.Release).Error()) {
+		return nil, nil
+	}
+	return rc.GetRelease(), err
+}
+
+func (h helm2) history(c *Chart) ([]*release.Release, error) {
+	// tiller returns no revisions unless we ask for them
+	rh, err := h.tillerClient().ReleaseHistory(c.Release, helm.WithMaxHistory(math.MaxInt32))
+	return rh.GetReleases(), err
+}
+
+func (h helm2) install(ctx context.Context, c *Chart, req *chart.Chart, dryRun bool) (rel *release.Release, err error) {
+	err = wait(ctx, func() error {
+		resp, err := h.tillerClient().InstallReleaseFromChart(
+			req,
+			c.Namespace,
+			helm.ReleaseName(c.Release),
+			helm.InstallWait(!dryRun),
+			helm.InstallTimeout(c.Timeout),
+			helm.ValueOverrides(c.Object),
+			helm.InstallDryRun(dryRun),
+		)
+		rel = resp.GetRelease()
+		return err
+	})
+	return rel, err
+}
+
+func (h helm2) upgrade(ctx context.Context, c *Chart, req *chart.Chart, dryRun bool) (rel *release.Release, err error) {
+	err = wait(ctx, func() error {
+		resp, err := h.tillerClient().UpdateReleaseFromChart(
+			c.Release,
+			req,
+			helm.UpgradeTimeout(c.Timeout),
+			helm.UpdateValueOverrides(c.Object),
+			helm.UpgradeDryRun(dryRun),
+			// an atomic upgrade only succeeds once its workloads are ready
+			helm.UpgradeWait(c.Atomic && !dryRun),
+		)
+		rel = resp.GetRelease()
+		return err
+	})
+	return rel, err
+}
+
+func (h helm2) rollback(ctx context.Context, c *Chart, revision int32) error {
+	return wait(ctx, func() error {
+		_, err := h.tillerClient().RollbackRelease(
+			c.Release,
+			helm.RollbackVersion(revision),
+			helm.RollbackWait(true),
+			helm.RollbackTimeout(c.Timeout),
+			helm.RollbackDryRun(c.DryRun),
+		)
+		return err
+	})
+}
+
+func (h helm2) delete(ctx context.Context, c *Chart) error {
+	return wait(ctx, func() error {
+		_, err := h.tillerClient().DeleteRelease(
+			c.Release,
+			helm.DeletePurge(true),
+			helm.DeleteTimeout(60),
+			helm.DeleteDryRun(c.DryRun),
+		)
+		return err
+	})
 }
 
 // NewFakeClient establishes a fake helm client
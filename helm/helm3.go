@@ -0,0 +1,364 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/protobuf/proto"
+	"github.com/monax/compass/kube"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/engine"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/releaseutil"
+	"k8s.io/helm/pkg/timeconv"
+	"k8s.io/helm/pkg/version"
+)
+
+// helm3 releases charts without tiller, rendering them locally and
+// recording each revision in a secret of the release namespace
+type helm3 struct {
+	*Tiller
+}
+
+func (h helm3) history(c *Chart) ([]*release.Release, error) {
+	if h.k8s == nil {
+		return nil, fmt.Errorf("helm 3 requires a kubernetes client")
+	}
+	return history3(h.k8s, c.Namespace, c.Release)
+}
+
+func (h helm3) content(c *Chart) (*release.Release, error) {
+	releases, err := h.history(c)
+	if err != nil {
+		return nil, err
+	} else if len(releases) > 0 {
+		return releases[len(releases)-1], nil
+	}
+
+	// don't install over a release which tiller still manages
+	records, _, err := history2(h.k8s, h.namespace, c.Release)
+	if apierrors.IsForbidden(err) || apierrors.IsNotFound(err) {
+		// we can't see any releases of tiller, so none could be moved
+		h.logger.Debugf("Couldn't check tiller for %s: %v", c.Release, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't check tiller for %s: %v", c.Release, err)
+	} else if len(records) > 0 {
+		return nil, fmt.Errorf("release %s is managed by helm 2, move it with: compass migrate %s", c.Release, c.Release)
+	}
+	return nil, nil
+}
+
+func (h helm3) install(ctx context.Context, c *Chart, req *chart.Chart, dryRun bool) (*release.Release, error) {
+	return h.release(ctx, c, req, dryRun)
+}
+
+func (h helm3) upgrade(ctx context.Context, c *Chart, req *chart.Chart, dryRun bool) (*release.Release, error) {
+	return h.release(ctx, c, req, dryRun)
+}
+
+// release renders the next revision of the chart and applies it
+func (h helm3) release(ctx context.Context, c *Chart, req *chart.Chart, dryRun bool) (*release.Release, error) {
+	releases, err := h.history(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var last *release.Release
+	revision := int32(1)
+	if len(releases) > 0 {
+		last = releases[len(releases)-1]
+		revision = last.GetVersion() + 1
+	}
+
+	caps, err := h.capabilities()
+	if err != nil {
+		return nil, err
+	}
+	rel, err := render(c, req, caps, revision, last == nil)
+	if err != nil || dryRun {
+		return rel, err
+	}
+
+	description := "Install complete"
+	if last != nil {
+		description = "Upgrade complete"
+	}
+	// as with tiller, installs and atomic upgrades wait for their workloads
+	return rel, h.deploy(ctx, c, rel, releases, description, last == nil || c.Atomic)
+}
+
+// deploy records the release as pending, applies its objects, removing
+// any left over from the previous revision, then records the outcome
+func (h helm3) deploy(ctx context.Context, c *Chart, rel *release.Release, releases []*release.Release, description string, wait bool) error {
+	pending := release.Status_PENDING_INSTALL
+	var previous string
+	if len(releases) > 0 {
+		pending = release.Status_PENDING_UPGRADE
+		previous = releases[len(releases)-1].GetManifest()
+	}
+	rel.Info.Status.Code = pending
+	if err := store3(h.k8s, rel, true); err != nil {
+		return err
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	err := h.apply(ctx, c, rel.GetManifest(), previous, wait)
+	if err != nil {
+		rel.Info.Status.Code = release.Status_FAILED
+		rel.Info.Description = err.Error()
+		if serr := store3(h.k8s, rel, false); serr != nil {
+			return fmt.Errorf("%v (couldn't record release: %v)", err, serr)
+		}
+		return err
+	}
+
+	rel.Info.Status.Code = release.Status_DEPLOYED
+	rel.Info.Description = description
+	if err = store3(h.k8s, rel, false); err != nil {
+		return err
+	}
+	for _, old := range releases {
+		if old.GetInfo().GetStatus().GetCode() == release.Status_DEPLOYED {
+			old.Info.Status.Code = release.Status_SUPERSEDED
+			if err = store3(h.k8s, old, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// apply installs or upgrades the objects of a manifest, then
+// deletes those which were only in the previous manifest
+func (h helm3) apply(ctx context.Context, c *Chart, manifest, previous string, wait bool) error {
+	if docs := documents(manifest); len(docs) > 0 {
+		m := &kube.Manifest{
+			Namespace: c.Namespace,
+			Timeout:   c.Timeout,
+			Wait:      wait,
+			Object:    []byte(strings.Join(docs, "\n---\n")),
+			K8s:       h.k8s,
+		}
+		if err := m.InstallOrUpgrade(ctx); err != nil {
+			return err
+		}
+	}
+
+	current := make(map[string]bool)
+	for _, doc := range documents(manifest) {
+		current[identify(doc)] = true
+	}
+	var orphans []string
+	for _, doc := range documents(previous) {
+		if !current[identify(doc)] {
+			orphans = append(orphans, doc)
+		}
+	}
+	return h.remove(ctx, c, orphans)
+}
+
+// remove deletes each object which still exists
+func (h helm3) remove(ctx context.Context, c *Chart, docs []string) error {
+	for _, doc := range docs {
+		m := &kube.Manifest{Namespace: c.Namespace, Timeout: c.Timeout, Object: []byte(doc), K8s: h.k8s}
+		if exists, _ := m.Status(ctx); !exists {
+			continue
+		}
+		if err := m.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h helm3) rollback(ctx context.Context, c *Chart, revision int32) error {
+	releases, err := h.history(c)
+	if err != nil {
+		return err
+	}
+
+	var target *release.Release
+	for _, rel := range releases {
+		if rel.GetVersion() == revision {
+			target = rel
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("revision %d of %s not found", revision, c.Release)
+	} else if c.DryRun {
+		fmt.Println(target.GetManifest())
+		return nil
+	}
+
+	// rolling back is an upgrade to a copy of the earlier revision
+	rel := proto.Clone(target).(*release.Release)
+	now := timeconv.Now()
+	rel.Version = releases[len(releases)-1].GetVersion() + 1
+	rel.Info = &release.Info{
+		Status:        &release.Status{Notes: target.GetInfo().GetStatus().GetNotes()},
+		FirstDeployed: releases[0].GetInfo().GetFirstDeployed(),
+		LastDeployed:  now,
+	}
+	return h.deploy(ctx, c, rel, releases, fmt.Sprintf("Rollback to %d", revision), true)
+}
+
+func (h helm3) delete(ctx context.Context, c *Chart) error {
+	releases, err := h.history(c)
+	if err != nil {
+		return err
+	} else if len(releases) == 0 {
+		return fmt.Errorf("release: %q not found", c.Release)
+	} else if c.DryRun {
+		h.logger.Infof("Would delete: %s (%d revisions)", c.Release, len(releases))
+		return nil
+	}
+
+	if err = h.remove(ctx, c, documents(releases[len(releases)-1].GetManifest())); err != nil {
+		return err
+	}
+	for _, rel := range releases {
+		name := secretName(rel.GetName(), rel.GetVersion())
+		if err = h.k8s.Secrets(c.Namespace).Delete(name, &metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capabilities reads the versions the cluster supports, as tiller would
+func (h helm3) capabilities() (*chartutil.Capabilities, error) {
+	disc := h.k8s.Discovery()
+	server, err := disc.ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get the kubernetes version: %v", err)
+	}
+	groups, err := disc.ServerGroups()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get the kubernetes api versions: %v", err)
+	}
+
+	versions := chartutil.DefaultVersionSet
+	if groups.Size() > 0 {
+		versions = chartutil.NewVersionSet(metav1.ExtractGroupVersions(groups)...)
+	}
+	return &chartutil.Capabilities{
+		APIVersions:   versions,
+		KubeVersion:   server,
+		TillerVersion: version.GetVersionProto(),
+	}, nil
+}
+
+// render templates the chart as tiller would, leaving out hooks
+func render(c *Chart, req *chart.Chart, caps *chartutil.Capabilities, revision int32, install bool) (*release.Release, error) {
+	config := &chart.Config{Raw: string(c.Object)}
+	if err := chartutil.ProcessRequirementsEnabled(req, config); err != nil {
+		return nil, err
+	}
+	if err := chartutil.ProcessRequirementsImportValues(req); err != nil {
+		return nil, err
+	}
+
+	now := timeconv.Now()
+	options := chartutil.ReleaseOptions{
+		Name:      c.Release,
+		Namespace: c.Namespace,
+		Time:      now,
+		Revision:  int(revision),
+		IsInstall: install,
+		IsUpgrade: !install,
+	}
+	values, err := chartutil.ToRenderValuesCaps(req, config, options, caps)
+	if err != nil {
+		return nil, err
+	}
+	values["Release"].(map[string]interface{})["Service"] = "Helm"
+
+	files, err := engine.New().Render(req, values)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var manifest strings.Builder
+	var notes string
+	for _, name := range names {
+		base := path.Base(name)
+		if base == "NOTES.txt" {
+			if name == path.Join(req.GetMetadata().GetName(), "templates", "NOTES.txt") {
+				notes = files[name]
+			}
+			continue
+		} else if strings.HasPrefix(base, "_") {
+			continue
+		}
+		for _, doc := range documents(files[name]) {
+			if events := hook(doc); events != "" {
+				return nil, fmt.Errorf("%s in %s is a %s hook, hooks can't be run for helm 3 releases", identify(doc), name, events)
+			}
+			fmt.Fprintf(&manifest, "---\n# Source: %s\n%s\n", name, doc)
+		}
+	}
+
+	return &release.Release{
+		Name:      c.Release,
+		Namespace: c.Namespace,
+		Version:   revision,
+		Chart:     req,
+		Config:    config,
+		Manifest:  manifest.String(),
+		Info: &release.Info{
+			Status:        &release.Status{Code: release.Status_UNKNOWN, Notes: notes},
+			FirstDeployed: now,
+			LastDeployed:  now,
+		},
+	}, nil
+}
+
+// documents splits a manifest into each of its objects, in order
+func documents(manifest string) []string {
+	split := releaseutil.SplitManifests(manifest)
+	docs := make([]string, 0, len(split))
+	for i := 0; i < len(split); i++ {
+		// comments alone are not objects
+		doc := split[fmt.Sprintf("manifest-%d", i)]
+		if identify(doc) != "/" {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+// identify returns the kind and name of the object in a document
+func identify(doc string) string {
+	var head releaseutil.SimpleHead
+	if err := yaml.Unmarshal([]byte(doc), &head); err != nil || head.Metadata == nil {
+		return fmt.Sprintf("%s/", head.Kind)
+	}
+	return fmt.Sprintf("%s/%s", head.Kind, head.Metadata.Name)
+}
+
+// hook returns the events of the object if it is a chart hook
+func hook(doc string) string {
+	var head releaseutil.SimpleHead
+	if err := yaml.Unmarshal([]byte(doc), &head); err != nil || head.Metadata == nil {
+		return ""
+	}
+	return head.Metadata.Annotations["helm.sh/hook"]
+}
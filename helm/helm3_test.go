@@ -0,0 +1,382 @@
+package helm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/monax/compass/kube"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kversion "k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	ktesting "k8s.io/client-go/testing"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+var testFiles = map[string]string{
+	"Chart.yaml":  "apiVersion: v1\nname: local\nversion: 0.1.0\n",
+	"values.yaml": "data: one\nextra: false\n",
+	"templates/config.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-config
+data:
+  data: {{ .Values.data }}
+`,
+	"templates/extra.yaml": `{{- if .Values.extra }}
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-extra
+{{- end }}
+`,
+	"templates/broken.yaml": `{{- if .Values.broken }}
+apiVersion: v1
+metadata:
+  name: {{ .Release.Name }}-broken
+{{- end }}
+`,
+	"templates/hook.yaml": `{{- if .Values.hook }}
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Release.Name }}-hook
+  annotations:
+    helm.sh/hook: pre-install
+{{- end }}
+`,
+	"templates/workload.yaml": `{{- if .Values.workload }}
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .Release.Name }}-workload
+{{- end }}
+`,
+	"templates/NOTES.txt": "Released {{ .Release.Name }}",
+}
+
+func newTestChart3(t *testing.T) Chart {
+	dir := t.TempDir()
+	for name, data := range testFiles {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+
+	chart := newTestChart()
+	chart.Name = dir
+	chart.Helm = 3
+	chart.Tiller.k8s = kube.NewFakeClient()
+	require.NoError(t, chart.Tiller.k8s.CreateNamespace(chart.Namespace))
+	return chart
+}
+
+func secrets(t *testing.T, c Chart) map[string]string {
+	list, err := c.k8s.Secrets(c.Namespace).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	status := make(map[string]string, len(list.Items))
+	for _, item := range list.Items {
+		status[item.Name] = item.Labels["status"]
+	}
+	return status
+}
+
+func TestHelm3(t *testing.T) {
+	ctx := context.Background()
+	chart := newTestChart3(t)
+
+	exists, err := chart.Status(ctx)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, chart.InstallOrUpgrade(ctx))
+	exists, err = chart.Status(ctx)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, map[string]string{"sh.helm.release.v1.test-release.v1": "deployed"}, secrets(t, chart))
+
+	notes, err := chart.Lookup(ctx, "notes", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "Released test-release", notes)
+
+	chart.SetInput([]byte("data: two\nextra: true\n"))
+	diff, err := chart.Diff(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, diff, "+  data: two")
+
+	require.NoError(t, chart.InstallOrUpgrade(ctx))
+	version, err := chart.Lookup(ctx, "version", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", version)
+	value, err := chart.Lookup(ctx, "values", "data")
+	assert.NoError(t, err)
+	assert.Equal(t, "two", value)
+	assert.Equal(t, map[string]string{
+		"sh.helm.release.v1.test-release.v1": "superseded",
+		"sh.helm.release.v1.test-release.v2": "deployed",
+	}, secrets(t, chart))
+
+	extra := &kube.Manifest{
+		Namespace: chart.Namespace,
+		Object:    []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: test-release-extra\n"),
+		K8s:       chart.k8s,
+	}
+	exists, err = extra.Status(ctx)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// rolling back removes what the upgrade added
+	require.NoError(t, chart.Rollback(ctx))
+	version, err = chart.Lookup(ctx, "version", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", version)
+	value, err = chart.Lookup(ctx, "values", "data")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", value)
+	exists, err = extra.Status(ctx)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, chart.Delete(ctx))
+	exists, err = chart.Status(ctx)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Empty(t, secrets(t, chart))
+
+	// hooks would otherwise be left out
+	chart.SetInput([]byte("hook: true\n"))
+	err = chart.InstallOrUpgrade(ctx)
+	assert.EqualError(t, err, "Job/test-release-hook in local/templates/hook.yaml is a pre-install hook, hooks can't be run for helm 3 releases")
+	assert.Empty(t, secrets(t, chart))
+
+	// a release we can't read is not taken as missing
+	chart.Tiller.k8s = nil
+	_, err = chart.Diff(ctx)
+	assert.EqualError(t, err, "helm 3 requires a kubernetes client")
+}
+
+func TestCapabilities(t *testing.T) {
+	chart := newTestChart3(t)
+	disc := chart.k8s.Discovery().(*fakediscovery.FakeDiscovery)
+	disc.FakedServerVersion = &kversion.Info{GitVersion: "v1.15.3"}
+	disc.Resources = []*metav1.APIResourceList{{GroupVersion: "example.com/v1"}}
+
+	caps, err := helm3{chart.Tiller}.capabilities()
+	require.NoError(t, err)
+	assert.Equal(t, "v1.15.3", caps.KubeVersion.GitVersion)
+	assert.True(t, caps.APIVersions.Has("example.com/v1"))
+	assert.False(t, caps.APIVersions.Has("extensions/v1beta1"))
+}
+
+func TestTillerUnreadable(t *testing.T) {
+	ctx := context.Background()
+	chart := newTestChart3(t)
+	// the fake clientset shares its reactors with its discovery
+	fake := chart.k8s.Discovery().(*fakediscovery.FakeDiscovery)
+	fake.PrependReactor("list", "configmaps", func(ktesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewInternalError(fmt.Errorf("unavailable"))
+	})
+	err := chart.InstallOrUpgrade(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "couldn't check tiller for test-release")
+
+	// without access to the records of tiller there are none to move
+	fake.PrependReactor("list", "configmaps", func(ktesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "", nil)
+	})
+	require.NoError(t, chart.InstallOrUpgrade(ctx))
+}
+
+func TestAtomic(t *testing.T) {
+	ctx := context.Background()
+	chart := newTestChart3(t)
+	chart.Atomic = true
+	require.NoError(t, chart.InstallOrUpgrade(ctx))
+
+	chart.SetInput([]byte("data: two\nbroken: true\n"))
+	err := chart.InstallOrUpgrade(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rolled back to 1")
+	assert.Equal(t, map[string]string{
+		"sh.helm.release.v1.test-release.v1": "superseded",
+		"sh.helm.release.v1.test-release.v2": "failed",
+		"sh.helm.release.v1.test-release.v3": "deployed",
+	}, secrets(t, chart))
+
+	value, err := chart.Lookup(ctx, "values", "data")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", value)
+
+	// the failed upgrade has already been reverted
+	require.NoError(t, chart.Rollback(ctx))
+	version, err := chart.Lookup(ctx, "version", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", version)
+
+	chart.Atomic = false
+	err = chart.InstallOrUpgrade(ctx)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "rolled back")
+	version, err = chart.Lookup(ctx, "version", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "4", version)
+	// atomic upgrades wait for their workloads to roll out
+	chart.Atomic = true
+	chart.Timeout = 1
+	chart.SetInput([]byte("workload: true\n"))
+	err = chart.InstallOrUpgrade(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rolled back to 3")
+}
+
+func TestRollbackTo(t *testing.T) {
+	ctx := context.Background()
+	chart := newTestChart3(t)
+	for _, data := range []string{"one", "two", "three"} {
+		chart.SetInput([]byte("data: " + data))
+		require.NoError(t, chart.InstallOrUpgrade(ctx))
+	}
+
+	revisions, err := chart.History(ctx)
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	assert.Equal(t, Revision{Version: 1, Status: "superseded", Chart: "0.1.0", Description: "Install complete"},
+		Revision{Version: revisions[0].Version, Status: revisions[0].Status, Chart: revisions[0].Chart, Description: revisions[0].Description})
+	assert.Equal(t, "deployed", revisions[2].Status)
+
+	// the default is the revision before the current one
+	require.NoError(t, chart.RollbackTo(ctx, 0))
+	value, err := chart.Lookup(ctx, "values", "data")
+	assert.NoError(t, err)
+	assert.Equal(t, "two", value)
+
+	require.NoError(t, chart.RollbackTo(ctx, 1))
+	value, err = chart.Lookup(ctx, "values", "data")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", value)
+
+	assert.Error(t, chart.RollbackTo(ctx, 9))
+}
+
+func TestEncode3(t *testing.T) {
+	rel := &release.Release{
+		Name:      "test-release",
+		Namespace: "test-namespace",
+		Version:   4,
+		Manifest:  "kind: ConfigMap",
+		Config:    &chart.Config{Raw: "data: two\n"},
+		Chart: &chart.Chart{
+			Metadata:  &chart.Metadata{Name: "local", Version: "0.1.0"},
+			Values:    &chart.Config{Raw: "data: one\n"},
+			Templates: []*chart.Template{{Name: "templates/config.yaml", Data: []byte("kind: ConfigMap")}},
+		},
+		Info: &release.Info{
+			Description: "Upgrade complete",
+			Status:      &release.Status{Code: release.Status_SUPERSEDED, Notes: "notes"},
+		},
+	}
+
+	data, err := encode3(rel)
+	require.NoError(t, err)
+	decoded, err := decode3([]byte(data))
+	require.NoError(t, err)
+
+	assert.Equal(t, rel.GetName(), decoded.GetName())
+	assert.Equal(t, rel.GetNamespace(), decoded.GetNamespace())
+	assert.Equal(t, rel.GetVersion(), decoded.GetVersion())
+	assert.Equal(t, rel.GetManifest(), decoded.GetManifest())
+	assert.Equal(t, rel.GetConfig().GetRaw(), decoded.GetConfig().GetRaw())
+	assert.Equal(t, rel.GetChart().GetValues().GetRaw(), decoded.GetChart().GetValues().GetRaw())
+	assert.Equal(t, rel.GetChart().GetMetadata(), decoded.GetChart().GetMetadata())
+	assert.Equal(t, rel.GetChart().GetTemplates(), decoded.GetChart().GetTemplates())
+	assert.Equal(t, rel.GetInfo().GetDescription(), decoded.GetInfo().GetDescription())
+	assert.Equal(t, rel.GetInfo().GetStatus(), decoded.GetInfo().GetStatus())
+}
+
+// tillerRecord encodes a revision of the release as tiller does,
+// gzipping the protobuf and then encoding it as base64
+func tillerRecord(t *testing.T, c Chart, version int32) string {
+	data, err := proto.Marshal(&release.Release{
+		Name:      c.Release,
+		Namespace: c.Namespace,
+		Version:   version,
+		Manifest:  "kind: ConfigMap",
+		Info:      &release.Info{Status: &release.Status{Code: release.Status_DEPLOYED}},
+	})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestMigrate(t *testing.T) {
+	// tiller records releases in config maps unless told to use secrets
+	for _, storage := range []storage2{tillerConfigMaps, tillerSecrets} {
+		t.Run(string(storage), func(t *testing.T) {
+			chart := newTestChart3(t)
+			k8s := chart.k8s
+
+			for version := int32(1); version <= 2; version++ {
+				meta := metav1.ObjectMeta{
+					Name:   secretName(chart.Release, version)[len("sh.helm.release.v1."):],
+					Labels: map[string]string{"OWNER": "TILLER", "NAME": chart.Release},
+				}
+				var err error
+				if storage == tillerSecrets {
+					_, err = k8s.Secrets("kube-system").Create(&v1.Secret{
+						ObjectMeta: meta,
+						Data:       map[string][]byte{"release": []byte(tillerRecord(t, chart, version))},
+					})
+				} else {
+					_, err = k8s.ConfigMaps("kube-system").Create(&v1.ConfigMap{
+						ObjectMeta: meta,
+						Data:       map[string]string{"release": tillerRecord(t, chart, version)},
+					})
+				}
+				require.NoError(t, err)
+			}
+
+			chart.Tiller.namespace = "kube-system"
+			_, err := chart.Status(context.Background())
+			assert.EqualError(t, err, "release test-release is managed by helm 2, move it with: compass migrate test-release")
+
+			revisions, err := Migrate(k8s, chart.Release, "kube-system", false, true)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, revisions)
+			assert.Empty(t, secrets(t, chart))
+
+			revisions, err = Migrate(k8s, chart.Release, "kube-system", true, false)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, revisions)
+			assert.Len(t, secrets(t, chart), 2)
+
+			version, err := chart.Lookup(context.Background(), "version", "")
+			assert.NoError(t, err)
+			assert.Equal(t, "2", version)
+
+			records, _, err := history2(k8s, "kube-system", chart.Release)
+			assert.NoError(t, err)
+			assert.Empty(t, records)
+
+			_, err = Migrate(k8s, chart.Release, "kube-system", false, false)
+			assert.Error(t, err)
+		})
+	}
+}
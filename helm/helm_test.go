@@ -1,6 +1,7 @@
 package helm
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -9,6 +10,7 @@ import (
 	"k8s.io/helm/pkg/downloader"
 	"k8s.io/helm/pkg/getter"
 	"k8s.io/helm/pkg/helm"
+	"k8s.io/helm/pkg/proto/hapi/release"
 )
 
 func newTestChart() Chart {
@@ -61,30 +63,49 @@ func TestDownload(t *testing.T) {
 func TestReleaseStatus(t *testing.T) {
 	chart := newTestChart()
 
-	_, err := chart.Status()
-	assert.Error(t, err, "release: \"test-release\" not found")
+	// a missing release is not an error
+	exists, err := chart.Status(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, exists)
 
 	_, err = chart.client.InstallRelease(chart.Name, chart.Namespace, helm.ReleaseName(chart.Release))
 	assert.NoError(t, err)
+
+	st, err := chart.ReleaseStatus(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, Deployed, st.State)
+	assert.Equal(t, "deployed at revision 1", st.String())
+
+	// only installing purges a release which never deployed
+	for _, code := range []release.Status_Code{release.Status_PENDING_INSTALL, release.Status_FAILED} {
+		chart.client = &helm.FakeClient{Rels: []*release.Release{{
+			Name: chart.Release,
+			Info: &release.Info{Status: &release.Status{Code: code}},
+		}}}
+		_, err = chart.Status(context.Background())
+		assert.NoError(t, err)
+		_, err = chart.client.ReleaseContent(chart.Release)
+		assert.NoError(t, err, "%v", code)
+	}
 }
 
 func TestDeleteChart(t *testing.T) {
 	chart := newTestChart()
 
-	err := chart.Delete()
+	err := chart.Delete(context.Background())
 	assert.Error(t, err, "release: \"test-release\" not found")
 
 	_, err = chart.client.InstallRelease(chart.Name, chart.Namespace, helm.ReleaseName(chart.Release))
 	assert.NoError(t, err)
 
-	err = chart.Delete()
+	err = chart.Delete(context.Background())
 	assert.NoError(t, err)
 }
 
 func TestInstallChart(t *testing.T) {
 	chart := newTestChart()
-	chart.InstallOrUpgrade()
-	out, _ := chart.Status()
+	chart.InstallOrUpgrade(context.Background())
+	out, _ := chart.Status(context.Background())
 	assert.Equal(t, true, out)
 }
 
@@ -94,8 +115,28 @@ func TestUpgradeChart(t *testing.T) {
 	_, err := chart.Tiller.client.InstallRelease(chart.Name, chart.Namespace, helm.ReleaseName(chart.Release), helm.InstallWait(true))
 	assert.NoError(t, err)
 
-	chart.InstallOrUpgrade()
-	out, err := chart.Status()
+	chart.InstallOrUpgrade(context.Background())
+	out, err := chart.Status(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, true, out)
 }
+
+func TestLookup(t *testing.T) {
+	chart := newTestChart()
+
+	_, err := chart.Lookup(context.Background(), "version", "")
+	assert.Error(t, err)
+
+	_, err = chart.client.InstallRelease(chart.Name, chart.Namespace, helm.ReleaseName(chart.Release))
+	assert.NoError(t, err)
+
+	version, err := chart.Lookup(context.Background(), "version", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", version)
+
+	_, err = chart.Lookup(context.Background(), "values", "")
+	assert.NoError(t, err)
+
+	_, err = chart.Lookup(context.Background(), "unknown", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,51 @@
+package helm
+
+import (
+	"fmt"
+
+	"github.com/monax/compass/kube"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Migrate copies each revision of a release from the config maps or secrets
+// of tiller into helm 3 secrets, removing the originals if cleanup is set, it
+// returns the number of revisions moved
+func Migrate(k8s *kube.K8s, name, tillerNamespace string, cleanup, dryRun bool) (int, error) {
+	releases, storage, err := history2(k8s, tillerNamespace, name)
+	if err != nil {
+		return 0, err
+	} else if len(releases) == 0 {
+		return 0, fmt.Errorf("release: %q not found in %s", name, tillerNamespace)
+	}
+
+	namespace := releases[len(releases)-1].GetNamespace()
+	existing, err := history3(k8s, namespace, name)
+	if err != nil {
+		return 0, err
+	} else if len(existing) > 0 {
+		return 0, fmt.Errorf("release: %q already managed by helm 3", name)
+	} else if dryRun {
+		return len(releases), nil
+	}
+
+	for _, rel := range releases {
+		if err = store3(k8s, rel, true); err != nil {
+			return 0, err
+		}
+	}
+
+	if cleanup {
+		for _, rel := range releases {
+			record := fmt.Sprintf("%s.v%d", rel.GetName(), rel.GetVersion())
+			if storage == tillerSecrets {
+				err = k8s.Secrets(tillerNamespace).Delete(record, &metav1.DeleteOptions{})
+			} else {
+				err = k8s.ConfigMaps(tillerNamespace).Delete(record, &metav1.DeleteOptions{})
+			}
+			if err != nil {
+				return len(releases), err
+			}
+		}
+	}
+	return len(releases), nil
+}
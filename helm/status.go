@@ -0,0 +1,158 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// State summarises a release, deciding how its chart is applied
+type State string
+
+const (
+	Missing  State = "missing"  // no release, install it
+	Deployed State = "deployed" // upgrade it
+	Failed   State = "failed"   // the last upgrade failed, upgrade it again
+	Broken   State = "broken"   // never deployed successfully, purge and install it
+	Deleted  State = "deleted"  // deleted but not purged, purge and install it
+	Pending  State = "pending"  // being changed by another operation, wait for it
+	Unknown  State = "unknown"  // helm doesn't know, nor do we
+)
+
+// defaultTimeout is how long we wait for a pending release if the chart has no timeout
+const defaultTimeout = 300 * time.Second
+
+// pollInterval is how often we check a pending release
+var pollInterval = 5 * time.Second
+
+// Status describes the latest revision of a release
+type Status struct {
+	State       State
+	Revision    int32               // zero if there is none
+	Code        release.Status_Code // as recorded by helm
+	Description string
+}
+
+// Installed returns true if the release should be upgraded rather than installed
+func (s Status) Installed() bool {
+	switch s.State {
+	case Deployed, Failed, Pending:
+		return true
+	}
+	return false
+}
+
+func (s Status) String() string {
+	state := string(s.State)
+	if s.State == Pending {
+		// say what is pending
+		state = statuses[s.Code]
+	}
+	if s.Revision == 0 {
+		return state
+	}
+	return fmt.Sprintf("%s at revision %d", state, s.Revision)
+}
+
+// ReleaseStatus reads the state of the release, without changing it
+func (c *Chart) ReleaseStatus(ctx context.Context) (Status, error) {
+	if err := ctx.Err(); err != nil {
+		return Status{State: Unknown}, err
+	}
+
+	rel, err := c.releases().content(c)
+	if err != nil {
+		return Status{State: Unknown}, err
+	} else if rel == nil {
+		return Status{State: Missing}, nil
+	}
+
+	st := Status{
+		Revision:    rel.GetVersion(),
+		Code:        rel.GetInfo().GetStatus().GetCode(),
+		Description: rel.GetInfo().GetDescription(),
+	}
+	switch st.Code {
+	case release.Status_DEPLOYED, release.Status_SUPERSEDED:
+		st.State = Deployed
+	case release.Status_FAILED:
+		releases, err := c.releases().history(c)
+		if err != nil {
+			return st, err
+		}
+		// helm won't upgrade a release which has never deployed
+		st.State = Failed
+		if lastDeployed(releases, math.MaxInt32) == 0 {
+			st.State = Broken
+		}
+	case release.Status_DELETED:
+		st.State = Deleted
+	case release.Status_PENDING_INSTALL, release.Status_PENDING_UPGRADE,
+		release.Status_PENDING_ROLLBACK, release.Status_DELETING:
+		st.State = Pending
+	default:
+		st.State = Unknown
+	}
+	return st, nil
+}
+
+// ready prepares the release to be installed or upgraded, purging it if it was
+// deleted or never deployed and waiting for it if it is still being changed
+func (c *Chart) ready(ctx context.Context) (Status, error) {
+	st, err := c.ReleaseStatus(ctx)
+	if err == nil && st.State == Pending {
+		st, err = c.settle(ctx, st)
+	}
+	if err != nil {
+		return st, err
+	}
+
+	switch st.State {
+	case Deleted, Broken:
+		if c.DryRun {
+			c.logger.Infof("Would purge: %s (%s)", c.Release, st)
+			return Status{State: Missing}, nil
+		}
+		c.logger.Infof("Purging: %s (%s)", c.Release, st)
+		if err = c.Delete(ctx); err != nil {
+			return st, fmt.Errorf("couldn't purge %s: %v", c.Release, err)
+		}
+		return Status{State: Missing}, nil
+	case Unknown:
+		return st, fmt.Errorf("release %s is in an unknown state at revision %d", c.Release, st.Revision)
+	}
+	return st, nil
+}
+
+// settle waits until the release is no longer pending, if it is
+// still pending after the timeout of the chart we take it as locked
+func (c *Chart) settle(ctx context.Context, st Status) (Status, error) {
+	timeout := time.Duration(c.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	c.logger.Infof("Waiting for: %s (%s)", c.Release, st)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for st.State == Pending {
+		select {
+		case <-ctx.Done():
+			return st, ctx.Err()
+		case <-deadline.C:
+			return st, fmt.Errorf("release %s is locked, %s for over %s: roll it back or delete it once nothing else is changing it", c.Release, st, timeout)
+		case <-ticker.C:
+			var err error
+			if st, err = c.ReleaseStatus(ctx); err != nil {
+				return st, err
+			}
+		}
+	}
+	return st, nil
+}
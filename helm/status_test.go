@@ -0,0 +1,125 @@
+package helm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// record stores a revision of the release with the given status
+func record(t *testing.T, c Chart, version int32, code release.Status_Code, create bool) {
+	require.NoError(t, store3(c.k8s, &release.Release{
+		Name:      c.Release,
+		Namespace: c.Namespace,
+		Version:   version,
+		Info:      &release.Info{Status: &release.Status{Code: code}},
+	}, create))
+}
+
+func TestStates(t *testing.T) {
+	ctx := context.Background()
+	states := []struct {
+		codes []release.Status_Code
+		state State
+	}{
+		{nil, Missing},
+		{[]release.Status_Code{release.Status_DEPLOYED}, Deployed},
+		{[]release.Status_Code{release.Status_DEPLOYED, release.Status_FAILED}, Failed},
+		{[]release.Status_Code{release.Status_FAILED, release.Status_FAILED}, Broken},
+		{[]release.Status_Code{release.Status_DELETED}, Deleted},
+		{[]release.Status_Code{release.Status_DEPLOYED, release.Status_PENDING_UPGRADE}, Pending},
+		{[]release.Status_Code{release.Status_DELETING}, Pending},
+		{[]release.Status_Code{release.Status_UNKNOWN}, Unknown},
+	}
+
+	for _, tt := range states {
+		chart := newTestChart3(t)
+		for i, code := range tt.codes {
+			record(t, chart, int32(i+1), code, true)
+		}
+		st, err := chart.ReleaseStatus(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.state, st.State, "%v", tt.codes)
+		assert.Equal(t, int32(len(tt.codes)), st.Revision)
+	}
+}
+
+func TestStatusReadOnly(t *testing.T) {
+	ctx := context.Background()
+	for _, code := range []release.Status_Code{release.Status_PENDING_INSTALL, release.Status_FAILED, release.Status_DELETED} {
+		chart := newTestChart3(t)
+		record(t, chart, 1, code, true)
+
+		// only installing purges a release
+		exists, err := chart.Status(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, code == release.Status_PENDING_INSTALL, exists, "%v", code)
+		_, err = chart.Diff(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, secrets(t, chart), 1, "%v", code)
+	}
+}
+
+func TestReady(t *testing.T) {
+	ctx := context.Background()
+	pollInterval = 10 * time.Millisecond
+
+	t.Run("Deleted", func(t *testing.T) {
+		chart := newTestChart3(t)
+		record(t, chart, 1, release.Status_DEPLOYED, true)
+		record(t, chart, 2, release.Status_DELETED, true)
+
+		// purged then installed again
+		require.NoError(t, chart.InstallOrUpgrade(ctx))
+		assert.Equal(t, map[string]string{"sh.helm.release.v1.test-release.v1": "deployed"}, secrets(t, chart))
+	})
+
+	t.Run("Broken", func(t *testing.T) {
+		chart := newTestChart3(t)
+		record(t, chart, 1, release.Status_FAILED, true)
+
+		chart.DryRun = true
+		require.NoError(t, chart.InstallOrUpgrade(ctx))
+		assert.Len(t, secrets(t, chart), 1)
+
+		chart.DryRun = false
+		require.NoError(t, chart.InstallOrUpgrade(ctx))
+		assert.Equal(t, map[string]string{"sh.helm.release.v1.test-release.v1": "deployed"}, secrets(t, chart))
+	})
+
+	t.Run("Pending", func(t *testing.T) {
+		chart := newTestChart3(t)
+		record(t, chart, 1, release.Status_DEPLOYED, true)
+		record(t, chart, 2, release.Status_PENDING_UPGRADE, true)
+
+		// another operation finishes while we wait
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			assert.NoError(t, store3(chart.k8s, &release.Release{
+				Name:      chart.Release,
+				Namespace: chart.Namespace,
+				Version:   2,
+				Info:      &release.Info{Status: &release.Status{Code: release.Status_DEPLOYED}},
+			}, false))
+		}()
+		require.NoError(t, chart.InstallOrUpgrade(ctx))
+		version, err := chart.Lookup(ctx, "version", "")
+		assert.NoError(t, err)
+		assert.Equal(t, "3", version)
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		chart := newTestChart3(t)
+		chart.Timeout = 1
+		record(t, chart, 1, release.Status_PENDING_INSTALL, true)
+
+		err := chart.InstallOrUpgrade(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "release test-release is locked, pending-install at revision 1")
+		assert.Len(t, secrets(t, chart), 1)
+	})
+}
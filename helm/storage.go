@@ -0,0 +1,322 @@
+package helm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/monax/compass/kube"
+	v1core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/releaseutil"
+	"k8s.io/helm/pkg/timeconv"
+)
+
+// secretType marks the secrets in which helm 3 records releases
+const secretType = "helm.sh/release.v1"
+
+// statuses are named as by helm 3
+var statuses = map[release.Status_Code]string{
+	release.Status_UNKNOWN:          "unknown",
+	release.Status_DEPLOYED:         "deployed",
+	release.Status_DELETED:          "uninstalled",
+	release.Status_SUPERSEDED:       "superseded",
+	release.Status_FAILED:           "failed",
+	release.Status_DELETING:         "uninstalling",
+	release.Status_PENDING_INSTALL:  "pending-install",
+	release.Status_PENDING_UPGRADE:  "pending-upgrade",
+	release.Status_PENDING_ROLLBACK: "pending-rollback",
+}
+
+// release3 is a release as helm 3 encodes it
+type release3 struct {
+	Name      string                 `json:"name,omitempty"`
+	Info      *info3                 `json:"info,omitempty"`
+	Chart     *chart3                `json:"chart,omitempty"`
+	Config    map[string]interface{} `json:"config,omitempty"`
+	Manifest  string                 `json:"manifest,omitempty"`
+	Version   int                    `json:"version,omitempty"`
+	Namespace string                 `json:"namespace,omitempty"`
+}
+
+type info3 struct {
+	FirstDeployed time.Time `json:"first_deployed,omitempty"`
+	LastDeployed  time.Time `json:"last_deployed,omitempty"`
+	Deleted       time.Time `json:"deleted"`
+	Description   string    `json:"description,omitempty"`
+	Status        string    `json:"status,omitempty"`
+	Notes         string    `json:"notes,omitempty"`
+}
+
+type chart3 struct {
+	Metadata  *chart.Metadata        `json:"metadata"`
+	Templates []*file3               `json:"templates"`
+	Values    map[string]interface{} `json:"values"`
+	Files     []*file3               `json:"files"`
+}
+
+type file3 struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+func secretName(name string, version int32) string {
+	return fmt.Sprintf("sh.helm.release.v1.%s.v%d", name, version)
+}
+
+// history3 reads each revision of a helm 3 release, oldest first
+func history3(k8s *kube.K8s, namespace, name string) ([]*release.Release, error) {
+	list, err := k8s.Secrets(namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("owner=helm,name=%s", name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	releases := make([]*release.Release, 0, len(list.Items))
+	for _, item := range list.Items {
+		rel, err := decode3(item.Data["release"])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode %s: %v", item.Name, err)
+		}
+		releases = append(releases, rel)
+	}
+	releaseutil.SortByRevision(releases)
+	return releases, nil
+}
+
+// store3 creates or updates the secret for a revision of a release
+func store3(k8s *kube.K8s, rel *release.Release, create bool) error {
+	data, err := encode3(rel)
+	if err != nil {
+		return err
+	}
+
+	secret := &v1core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName(rel.GetName(), rel.GetVersion()),
+			Namespace: rel.GetNamespace(),
+			Labels: map[string]string{
+				"name":    rel.GetName(),
+				"owner":   "helm",
+				"status":  statuses[rel.GetInfo().GetStatus().GetCode()],
+				"version": strconv.Itoa(int(rel.GetVersion())),
+			},
+		},
+		Type: secretType,
+		Data: map[string][]byte{"release": []byte(data)},
+	}
+	if create {
+		_, err = k8s.Secrets(rel.GetNamespace()).Create(secret)
+	} else {
+		_, err = k8s.Secrets(rel.GetNamespace()).Update(secret)
+	}
+	return err
+}
+
+// storage2 is where tiller records releases, as chosen by its --storage flag
+type storage2 string
+
+const (
+	tillerConfigMaps storage2 = "configmaps" // the default
+	tillerSecrets    storage2 = "secrets"
+)
+
+// history2 reads each revision of a release from the config maps or
+// secrets of tiller, returning which of them held the records
+func history2(k8s *kube.K8s, namespace, name string) ([]*release.Release, storage2, error) {
+	selector := metav1.ListOptions{LabelSelector: fmt.Sprintf("OWNER=TILLER,NAME=%s", name)}
+	records := make(map[string][]byte)
+	storage := tillerConfigMaps
+	cms, err := k8s.ConfigMaps(namespace).List(selector)
+	if err != nil {
+		return nil, storage, err
+	}
+	for _, item := range cms.Items {
+		records[item.Name] = []byte(item.Data["release"])
+	}
+	if len(records) == 0 {
+		storage = tillerSecrets
+		list, err := k8s.Secrets(namespace).List(selector)
+		if err != nil {
+			return nil, storage, err
+		}
+		for _, item := range list.Items {
+			records[item.Name] = item.Data["release"]
+		}
+	}
+
+	releases := make([]*release.Release, 0, len(records))
+	for item, record := range records {
+		data, err := unzip(record)
+		if err != nil {
+			return nil, storage, fmt.Errorf("couldn't decode %s: %v", item, err)
+		}
+		rel := new(release.Release)
+		if err = proto.Unmarshal(data, rel); err != nil {
+			return nil, storage, fmt.Errorf("couldn't decode %s: %v", item, err)
+		}
+		releases = append(releases, rel)
+	}
+	releaseutil.SortByRevision(releases)
+	return releases, storage, nil
+}
+
+// encode3 converts the release to json, then compresses and encodes it
+func encode3(rel *release.Release) (string, error) {
+	values, err := toMap(rel.GetChart().GetValues().GetRaw())
+	if err != nil {
+		return "", err
+	}
+	config, err := toMap(rel.GetConfig().GetRaw())
+	if err != nil {
+		return "", err
+	}
+
+	ch := &chart3{Metadata: rel.GetChart().GetMetadata(), Values: values}
+	for _, tmpl := range rel.GetChart().GetTemplates() {
+		ch.Templates = append(ch.Templates, &file3{Name: tmpl.GetName(), Data: tmpl.GetData()})
+	}
+	for _, file := range rel.GetChart().GetFiles() {
+		ch.Files = append(ch.Files, &file3{Name: file.GetTypeUrl(), Data: file.GetValue()})
+	}
+
+	info := rel.GetInfo()
+	data, err := json.Marshal(&release3{
+		Name: rel.GetName(),
+		Info: &info3{
+			FirstDeployed: stamp(info.GetFirstDeployed()),
+			LastDeployed:  stamp(info.GetLastDeployed()),
+			Description:   info.GetDescription(),
+			Status:        statuses[info.GetStatus().GetCode()],
+			Notes:         info.GetStatus().GetNotes(),
+		},
+		Chart:     ch,
+		Config:    config,
+		Manifest:  rel.GetManifest(),
+		Version:   int(rel.GetVersion()),
+		Namespace: rel.GetNamespace(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.Write(data); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// stamp converts the timestamp, which may be unset
+func stamp(ts *timestamp.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return timeconv.Time(ts)
+}
+
+// decode3 reverses encode3
+func decode3(data []byte) (*release.Release, error) {
+	data, err := unzip(data)
+	if err != nil {
+		return nil, err
+	}
+	var r3 release3
+	if err = json.Unmarshal(data, &r3); err != nil {
+		return nil, err
+	}
+
+	rel := &release.Release{
+		Name:      r3.Name,
+		Manifest:  r3.Manifest,
+		Version:   int32(r3.Version),
+		Namespace: r3.Namespace,
+		Info:      &release.Info{Status: &release.Status{}},
+	}
+	if r3.Info != nil {
+		rel.Info.FirstDeployed = timeconv.Timestamp(r3.Info.FirstDeployed)
+		rel.Info.LastDeployed = timeconv.Timestamp(r3.Info.LastDeployed)
+		rel.Info.Description = r3.Info.Description
+		rel.Info.Status.Notes = r3.Info.Notes
+		for code, name := range statuses {
+			if name == r3.Info.Status {
+				rel.Info.Status.Code = code
+			}
+		}
+	}
+	if rel.Config, err = fromMap(r3.Config); err != nil {
+		return nil, err
+	}
+	if r3.Chart != nil {
+		rel.Chart = &chart.Chart{Metadata: r3.Chart.Metadata}
+		if rel.Chart.Values, err = fromMap(r3.Chart.Values); err != nil {
+			return nil, err
+		}
+		for _, tmpl := range r3.Chart.Templates {
+			rel.Chart.Templates = append(rel.Chart.Templates, &chart.Template{Name: tmpl.Name, Data: tmpl.Data})
+		}
+		for _, file := range r3.Chart.Files {
+			rel.Chart.Files = append(rel.Chart.Files, &any.Any{TypeUrl: file.Name, Value: file.Data})
+		}
+	}
+	return rel, nil
+}
+
+// unzip decodes the data, then decompresses it if needed
+func unzip(data []byte) ([]byte, error) {
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(decoded, data)
+	if err != nil {
+		return nil, err
+	}
+	decoded = decoded[:n]
+
+	// gzip magic header
+	if len(decoded) > 3 && bytes.Equal(decoded[0:3], []byte{0x1f, 0x8b, 0x08}) {
+		r, err := gzip.NewReader(bytes.NewReader(decoded))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return decoded, nil
+}
+
+func toMap(raw string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(raw), &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func fromMap(values map[string]interface{}) (*chart.Config, error) {
+	if len(values) == 0 {
+		return &chart.Config{}, nil
+	}
+	raw, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return &chart.Config{Raw: string(raw)}, nil
+}
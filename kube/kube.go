@@ -2,6 +2,7 @@ package kube
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,12 +12,15 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	v1core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	dfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes"
 	kfake "k8s.io/client-go/kubernetes/fake"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/portforward"
@@ -28,11 +32,13 @@ import (
 
 // K8s represents a connection to kubernetes
 type K8s struct {
-	typed   kubernetes.Interface
-	dynamic dynamic.Interface
-	config  *rest.Config
-	base    clientcmd.ClientConfig
-	logger  *log.Entry
+	DryRun   bool `json:"-"` // changes are validated by the server but not persisted
+	Parallel int  `json:"-"` // maximum objects applied at once per manifest, unlimited if zero
+	typed    kubernetes.Interface
+	dynamic  dynamic.Interface
+	config   *rest.Config
+	base     clientcmd.ClientConfig
+	logger   *log.Entry
 }
 
 // NewClient populates a new connection
@@ -131,25 +137,32 @@ func (k8s *K8s) getPodLogs(namespace, name string) (string, error) {
 	return buf.String(), err
 }
 
-func (k8s *K8s) waitPod(namespace, pod string, remove bool, timeout int64) error {
+func (k8s *K8s) waitPod(ctx context.Context, namespace, pod string, remove bool, timeout int64) error {
 	// make a watcher to wait for this pod to be ready
 	watch, err := k8s.typed.CoreV1().Pods(namespace).Watch(metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", pod), TimeoutSeconds: &timeout})
 	if err != nil {
 		return err
 	}
+	defer watch.Stop()
 
-	for event := range watch.ResultChan() {
-		phase := event.Object.(*v1core.Pod).Status.Phase
-		if phase == v1core.PodSucceeded {
-			return k8s.getLogsAndDelete(namespace, pod)
-		} else if phase == v1core.PodFailed || phase == v1core.PodUnknown {
-			return k8s.getLogsAndDelete(namespace, pod)
-		} else if phase == v1core.PodRunning {
-			return nil
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-watch.ResultChan():
+			if !ok {
+				return fmt.Errorf("something went wrong waiting for pod")
+			}
+			phase := event.Object.(*v1core.Pod).Status.Phase
+			if phase == v1core.PodSucceeded {
+				return k8s.getLogsAndDelete(namespace, pod)
+			} else if phase == v1core.PodFailed || phase == v1core.PodUnknown {
+				return k8s.getLogsAndDelete(namespace, pod)
+			} else if phase == v1core.PodRunning {
+				return nil
+			}
 		}
 	}
-
-	return fmt.Errorf("something went wrong waiting for pod")
 }
 
 func (k8s *K8s) getLogsAndDelete(namespace, pod string) error {
@@ -164,10 +177,10 @@ func (k8s *K8s) getLogsAndDelete(namespace, pod string) error {
 // FromConfigMap reads an entry from a ConfigMap
 func (k8s *K8s) FromConfigMap(name, namespace, key string) (result string, err error) {
 	cm, err := k8s.typed.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
-	if cm == nil {
-		return result, errors.New("failed to get configmap")
-	} else if err != nil {
+	if err != nil {
 		return "", err
+	} else if cm == nil {
+		return result, errors.New("failed to get configmap")
 	}
 	return cm.Data[key], nil
 }
@@ -175,14 +188,71 @@ func (k8s *K8s) FromConfigMap(name, namespace, key string) (result string, err e
 // FromSecret reads an entry from a Secret
 func (k8s *K8s) FromSecret(name, namespace, key string) (result string, err error) {
 	sec, err := k8s.typed.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
-	if sec == nil {
-		return result, errors.New("failed to get secret")
-	} else if err != nil {
+	if err != nil {
 		return "", err
+	} else if sec == nil {
+		return result, errors.New("failed to get secret")
 	}
 	return string(sec.Data[key]), nil
 }
 
+// ToConfigMap writes an entry to a ConfigMap, creating it if necessary
+func (k8s *K8s) ToConfigMap(name, namespace, key, value string) error {
+	client := k8s.typed.CoreV1().ConfigMaps(namespace)
+	cm, err := client.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1core.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+		cm.Data = map[string]string{key: value}
+		_, err = client.Create(cm)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string, 1)
+	}
+	cm.Data[key] = value
+	_, err = client.Update(cm)
+	return err
+}
+
+// ToSecret writes an entry to a Secret, creating it if necessary
+func (k8s *K8s) ToSecret(name, namespace, key, value string) error {
+	client := k8s.typed.CoreV1().Secrets(namespace)
+	sec, err := client.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		sec = &v1core.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+		sec.Data = map[string][]byte{key: []byte(value)}
+		_, err = client.Create(sec)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if sec.Data == nil {
+		sec.Data = make(map[string][]byte, 1)
+	}
+	sec.Data[key] = []byte(value)
+	_, err = client.Update(sec)
+	return err
+}
+
+// Secrets returns a client for the Secrets in a namespace
+func (k8s *K8s) Secrets(namespace string) corev1.SecretInterface {
+	return k8s.typed.CoreV1().Secrets(namespace)
+}
+
+// ConfigMaps returns a client for the ConfigMaps in a namespace
+func (k8s *K8s) ConfigMaps(namespace string) corev1.ConfigMapInterface {
+	return k8s.typed.CoreV1().ConfigMaps(namespace)
+}
+
+// Discovery returns a client for the versions and resources the server supports
+func (k8s *K8s) Discovery() discovery.DiscoveryInterface {
+	return k8s.typed.Discovery()
+}
+
 // CreateNamespace tells the k8s api to make a namespace
 func (k8s *K8s) CreateNamespace(name string) error {
 	ns := &v1core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
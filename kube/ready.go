@@ -0,0 +1,96 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// pollInterval is how often we check a workload which has not rolled out
+var pollInterval = 2 * time.Second
+
+// workloads are the kinds which are waited on until they are ready
+var workloads = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+	"Job":         true,
+}
+
+// waitReady polls a workload until it is ready, or the timeout of the manifest passes
+func (m *Manifest) waitReady(ctx context.Context, ri dynamic.ResourceInterface, name string) error {
+	var deadline <-chan time.Time
+	if m.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(m.Timeout) * time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		obj, err := ri.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if done, err := ready(obj); err != nil || done {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("%s/%s not ready after %ds", obj.GetKind(), name, m.Timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// ready returns true once a workload has rolled out, or an error if a job failed
+func ready(obj *unstructured.Unstructured) (bool, error) {
+	status := func(field string) int64 {
+		n, _, _ := unstructured.NestedInt64(obj.Object, "status", field)
+		return n
+	}
+	spec := func(field string) int64 {
+		if n, found, _ := unstructured.NestedInt64(obj.Object, "spec", field); found {
+			return n
+		}
+		return 1
+	}
+	// the status may not yet describe the latest spec
+	if status("observedGeneration") < obj.GetGeneration() && obj.GetKind() != "Job" {
+		return false, nil
+	}
+
+	switch obj.GetKind() {
+	case "Deployment":
+		replicas := spec("replicas")
+		return status("updatedReplicas") >= replicas && status("availableReplicas") >= replicas, nil
+	case "StatefulSet":
+		replicas := spec("replicas")
+		strategy, _, _ := unstructured.NestedString(obj.Object, "spec", "updateStrategy", "type")
+		if strategy == "OnDelete" {
+			// pods are only updated once they are deleted
+			return status("readyReplicas") >= replicas, nil
+		}
+		return status("updatedReplicas") >= replicas && status("readyReplicas") >= replicas, nil
+	case "DaemonSet":
+		desired := status("desiredNumberScheduled")
+		return status("updatedNumberScheduled") >= desired && status("numberAvailable") >= desired, nil
+	case "Job":
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		for _, c := range conditions {
+			if cond, ok := c.(map[string]interface{}); ok && cond["type"] == "Failed" && cond["status"] == "True" {
+				return false, fmt.Errorf("job %s failed: %v", obj.GetName(), cond["message"])
+			}
+		}
+		return status("succeeded") >= spec("completions"), nil
+	}
+	return true, nil
+}
@@ -0,0 +1,100 @@
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+func workload(t *testing.T, data string) *unstructured.Unstructured {
+	// decoded as the dynamic client would, with integers as int64
+	json, err := kyaml.ToJSON([]byte(data))
+	require.NoError(t, err)
+	obj := new(unstructured.Unstructured)
+	require.NoError(t, obj.UnmarshalJSON(json))
+	return obj
+}
+
+func TestReady(t *testing.T) {
+	for name, test := range map[string]struct {
+		data  string
+		ready bool
+		err   bool
+	}{
+		"RolledOut": {data: `
+kind: Deployment
+metadata: {generation: 2}
+spec: {replicas: 2}
+status: {observedGeneration: 2, updatedReplicas: 2, availableReplicas: 2}
+`, ready: true},
+		"Unobserved": {data: `
+kind: Deployment
+metadata: {generation: 2}
+spec: {replicas: 2}
+status: {observedGeneration: 1, updatedReplicas: 2, availableReplicas: 2}
+`},
+		"Unavailable": {data: `
+kind: StatefulSet
+status: {updatedReplicas: 1, readyReplicas: 0}
+`},
+		"OnDelete": {data: `
+kind: StatefulSet
+spec: {updateStrategy: {type: OnDelete}}
+status: {readyReplicas: 1}
+`, ready: true},
+		"Scheduled": {data: `
+kind: DaemonSet
+status: {desiredNumberScheduled: 3, updatedNumberScheduled: 3, numberAvailable: 3}
+`, ready: true},
+		"Running": {data: `
+kind: Job
+spec: {completions: 2}
+status: {succeeded: 1}
+`},
+		"Failed": {data: `
+kind: Job
+status: {conditions: [{type: Failed, status: "True", message: BackoffLimitExceeded}]}
+`, err: true},
+		"Other": {data: `kind: ConfigMap`, ready: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ready, err := ready(workload(t, test.data))
+			assert.Equal(t, test.err, err != nil)
+			assert.Equal(t, test.ready, ready)
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	m := newTestManifest()
+	m.Wait = true
+	m.Timeout = 1
+	m.SetInput([]byte(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 1
+status:
+  updatedReplicas: 1
+  availableReplicas: 1
+`))
+	require.NoError(t, m.InstallOrUpgrade(context.Background()))
+
+	m.SetInput([]byte(`
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: job
+`))
+	err := m.InstallOrUpgrade(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Job/job not ready after 1s")
+}
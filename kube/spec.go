@@ -2,15 +2,25 @@ package kube
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/monax/compass/util"
 	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
 	v1core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	kyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/restmapper"
 
@@ -23,8 +33,13 @@ type Manifest struct {
 	Namespace string `yaml:"namespace"` // namespace
 	Timeout   int64  `yaml:"timeout"`   // install / upgrade wait time
 	Remove    bool   `yaml:"remove"`    // remove once installed
+	Wait      bool   `yaml:"wait"`      // wait for workloads to roll out
 	Object    []byte
 	*K8s
+
+	mu       sync.Mutex
+	previous []*unstructured.Unstructured // live objects replaced by the last apply
+	created  []*unstructured.Unstructured // objects which did not exist before the last apply
 }
 
 // Lint checks that our definition has a namespace
@@ -50,13 +65,26 @@ func (m *Manifest) Connect(k8s interface{}) {
 	m.K8s = k8s.(*K8s)
 }
 
+// decode reads an object, those of kinds which are not built in,
+// such as custom resources, are read as unstructured
+func decode(obj []byte) (runtime.Object, *schema.GroupVersionKind, error) {
+	spec, gvk, err := scheme.Codecs.UniversalDeserializer().Decode(obj, nil, nil)
+	if !runtime.IsNotRegisteredError(err) {
+		return spec, gvk, err
+	}
+	data, err := kyaml.ToJSON(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	return unstructured.UnstructuredJSONScheme.Decode(data, nil, nil)
+}
+
 func (m *Manifest) buildObjects() ([]runtime.Object, error) {
-	decode := scheme.Codecs.UniversalDeserializer().Decode
 	objs := bytes.Split(m.Object, []byte("---"))
 	m.logger.Infof("Given %d specification(s)", len(objs))
 	var specs []runtime.Object
 	for _, obj := range objs {
-		spec, _, err := decode(obj, nil, nil)
+		spec, _, err := decode(obj)
 		if err != nil {
 			return nil, err
 		}
@@ -65,6 +93,72 @@ func (m *Manifest) buildObjects() ([]runtime.Object, error) {
 	return specs, nil
 }
 
+// Names lists each object in the manifest as Kind/name
+func (m *Manifest) Names() []string {
+	var names []string
+	for _, obj := range bytes.Split(m.Object, []byte("---")) {
+		spec, gvk, err := decode(obj)
+		if err != nil {
+			continue
+		}
+		if meta, err := apimeta.Accessor(spec); err == nil {
+			names = append(names, fmt.Sprintf("%s/%s", gvk.Kind, meta.GetName()))
+		}
+	}
+	return names
+}
+
+// Lookup reads a field from a live object in the manifest, given as Kind/name,
+// the data of a secret is decoded
+func (m *Manifest) Lookup(ctx context.Context, object, path string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	for _, obj := range bytes.Split(m.Object, []byte("---")) {
+		spec, gvk, err := decode(obj)
+		if err != nil {
+			continue
+		}
+		meta, err := apimeta.Accessor(spec)
+		if err != nil || fmt.Sprintf("%s/%s", gvk.Kind, meta.GetName()) != object {
+			continue
+		}
+
+		resourceInterface, err := m.resource(*gvk)
+		if err != nil {
+			return "", err
+		}
+		live, err := resourceInterface.Get(meta.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		fields := strings.Split(path, ".")
+		value, found, err := unstructured.NestedFieldNoCopy(live.Object, fields...)
+		if err != nil {
+			return "", err
+		} else if !found {
+			return "", fmt.Errorf("%s has no field %s", object, path)
+		}
+
+		switch v := value.(type) {
+		case string:
+			if gvk.Kind == "Secret" && fields[0] == "data" {
+				data, err := base64.StdEncoding.DecodeString(v)
+				return string(data), err
+			}
+			return v, nil
+		case map[string]interface{}, []interface{}:
+			data, err := json.Marshal(v)
+			return string(data), err
+		default:
+			return fmt.Sprintf("%v", v), nil
+		}
+	}
+	return "", fmt.Errorf("object %s not in manifest", object)
+}
+
 type action string
 
 const (
@@ -74,16 +168,15 @@ const (
 	delete  action = "delete"
 )
 
-// Execute performs actions against the kubernetes api
-func (m *Manifest) Execute(spec runtime.Object, do action, result chan error) {
-	gvk := spec.GetObjectKind().GroupVersionKind()
+// resource finds the dynamic interface for the given kind, in
+// our namespace unless the kind is cluster scoped
+func (m *Manifest) resource(gvk schema.GroupVersionKind) (dynamic.ResourceInterface, error) {
 	gvr := schema.GroupVersionResource{Group: gvk.Group, Version: gvk.Version}
 
 	// this is empty if using the fake client
 	groupResources, err := restmapper.GetAPIGroupResources(m.K8s.typed.Discovery())
 	if err != nil {
-		result <- err
-		return
+		return nil, err
 	}
 
 	if len(groupResources) != 0 {
@@ -91,13 +184,29 @@ func (m *Manifest) Execute(spec runtime.Object, do action, result chan error) {
 		rm := restmapper.NewDiscoveryRESTMapper(groupResources)
 		mapping, err := rm.RESTMapping(gk, gvk.Version)
 		if err != nil {
-			result <- err
-			return
+			return nil, err
 		}
 		gvr = mapping.Resource
+		if mapping.Scope.Name() != apimeta.RESTScopeNameNamespace {
+			return m.K8s.dynamic.Resource(gvr), nil
+		}
 	}
 
-	resourceInterface := m.K8s.dynamic.Resource(gvr).Namespace(m.Namespace)
+	return m.K8s.dynamic.Resource(gvr).Namespace(m.Namespace), nil
+}
+
+// Execute performs actions against the kubernetes api
+func (m *Manifest) Execute(ctx context.Context, spec runtime.Object, do action, result chan error) {
+	if err := ctx.Err(); err != nil {
+		result <- err
+		return
+	}
+
+	resourceInterface, err := m.resource(spec.GetObjectKind().GroupVersionKind())
+	if err != nil {
+		result <- err
+		return
+	}
 
 	// convert the object to unstructured
 	unstruct, err := runtime.DefaultUnstructuredConverter.ToUnstructured(spec)
@@ -109,25 +218,35 @@ func (m *Manifest) Execute(spec runtime.Object, do action, result chan error) {
 
 	switch action(do) {
 	case install, upgrade:
-		uns, err := resourceInterface.Get(obj.GetName(), metav1.GetOptions{})
-		if err != nil && uns == nil {
-			_, err = resourceInterface.Create(&obj, metav1.CreateOptions{})
+		live, _ := resourceInterface.Get(obj.GetName(), metav1.GetOptions{})
+		if live == nil {
+			if _, err = resourceInterface.Create(&obj, metav1.CreateOptions{DryRun: m.dryRun()}); err == nil {
+				m.record(nil, &obj)
+			}
+			break
+		}
+		if _, err = resourceInterface.Update(&obj, metav1.UpdateOptions{DryRun: m.dryRun()}); err == nil {
+			m.record(live, nil)
 		}
-		_, err = resourceInterface.Update(&obj, metav1.UpdateOptions{})
 	case status:
 		_, err = resourceInterface.Get(obj.GetName(), metav1.GetOptions{})
 	case delete:
-		err = resourceInterface.Delete(obj.GetName(), &metav1.DeleteOptions{})
+		err = resourceInterface.Delete(obj.GetName(), &metav1.DeleteOptions{DryRun: m.dryRun()})
 	default:
 		result <- fmt.Errorf("action type '%v' unknown", do)
 		return
 	}
 
-	if err == nil {
+	if err == nil && !m.DryRun {
 		switch def := spec.(type) {
 		case *v1core.Pod:
 			m.logger.Infof("Waiting for pod: %s", def.Name)
-			err = m.waitPod(m.Namespace, def.GetName(), m.Remove, m.Timeout)
+			err = m.waitPod(ctx, m.Namespace, def.GetName(), m.Remove, m.Timeout)
+		default:
+			if m.Wait && (do == install || do == upgrade) && workloads[obj.GetKind()] {
+				m.logger.Infof("Waiting for: %s/%s", obj.GetKind(), obj.GetName())
+				err = m.waitReady(ctx, resourceInterface, obj.GetName())
+			}
 		}
 	}
 
@@ -135,8 +254,31 @@ func (m *Manifest) Execute(spec runtime.Object, do action, result chan error) {
 	return
 }
 
+// dryRun returns the server-side dry-run directive, if enabled
+func (m *Manifest) dryRun() []string {
+	if m.DryRun {
+		return []string{metav1.DryRunAll}
+	}
+	return nil
+}
+
+// record keeps track of applied changes so that they can be reverted
+func (m *Manifest) record(previous, created *unstructured.Unstructured) {
+	if m.DryRun {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if previous != nil {
+		m.previous = append(m.previous, previous)
+	}
+	if created != nil {
+		m.created = append(m.created, created)
+	}
+}
+
 // Workflow executes against each kubernetes spec
-func (m *Manifest) Workflow(do action) error {
+func (m *Manifest) Workflow(ctx context.Context, do action) error {
 	m.logger = log.WithFields(log.Fields{
 		"kind": "kubernetes",
 	})
@@ -146,12 +288,29 @@ func (m *Manifest) Workflow(do action) error {
 		return err
 	}
 
+	if do == install || do == upgrade {
+		m.mu.Lock()
+		m.previous, m.created = nil, nil
+		m.mu.Unlock()
+	}
+
 	results := make(chan error, len(specs))
 
+	// bound the number of objects in flight, if requested
+	slots := len(specs)
+	if m.K8s.Parallel > 0 && m.K8s.Parallel < slots {
+		slots = m.K8s.Parallel
+	}
+	sem := make(chan struct{}, slots)
+
 	for _, spec := range specs {
 		if spec != nil {
 			// we don't want to block here
-			go m.Execute(spec, do, results)
+			go func(spec runtime.Object) {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				m.Execute(ctx, spec, do, results)
+			}(spec)
 		}
 	}
 
@@ -169,8 +328,8 @@ func (m *Manifest) Workflow(do action) error {
 }
 
 // Status returns true if the objects exists
-func (m *Manifest) Status() (bool, error) {
-	err := m.Workflow(status)
+func (m *Manifest) Status(ctx context.Context) (bool, error) {
+	err := m.Workflow(ctx, status)
 	if err != nil {
 		return false, nil
 	}
@@ -178,15 +337,154 @@ func (m *Manifest) Status() (bool, error) {
 }
 
 // Install the decoded kubernetes objects
-func (m *Manifest) InstallOrUpgrade() error {
+func (m *Manifest) InstallOrUpgrade(ctx context.Context) error {
 	if m.Namespace == "" {
 		ns, _, _ := m.base.Namespace()
 		m.Namespace = ns
 	}
-	return m.Workflow(upgrade)
+	return m.Workflow(ctx, upgrade)
+}
+
+// Rollback restores any objects replaced by the last install / upgrade
+// and removes those which were newly created
+func (m *Manifest) Rollback(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	allErr := make([]error, 0)
+	for _, obj := range m.previous {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ri, err := m.resource(obj.GroupVersionKind())
+		if err != nil {
+			allErr = append(allErr, err)
+			continue
+		}
+		// server managed fields would conflict with the current object
+		obj.SetResourceVersion("")
+		unstructured.RemoveNestedField(obj.Object, "status")
+		m.logger.Infof("Restoring: %s/%s", obj.GetKind(), obj.GetName())
+		if _, err = ri.Update(obj, metav1.UpdateOptions{}); err != nil {
+			allErr = append(allErr, err)
+		}
+	}
+	for _, obj := range m.created {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ri, err := m.resource(obj.GroupVersionKind())
+		if err != nil {
+			allErr = append(allErr, err)
+			continue
+		}
+		m.logger.Infof("Removing: %s/%s", obj.GetKind(), obj.GetName())
+		if err = ri.Delete(obj.GetName(), &metav1.DeleteOptions{}); err != nil {
+			allErr = append(allErr, err)
+		}
+	}
+	m.previous, m.created = nil, nil
+
+	if len(allErr) > 0 {
+		return fmt.Errorf("error(s) encountered during rollback: %v", allErr)
+	}
+	return nil
+}
+
+// serverFields are set by the api server and so are ignored in comparisons
+var serverFields = [][]string{
+	{"status"},
+	{"metadata", "creationTimestamp"},
+	{"metadata", "generation"},
+	{"metadata", "managedFields"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "selfLink"},
+	{"metadata", "uid"},
+	{"metadata", "annotations", "kubectl.kubernetes.io/last-applied-configuration"},
+	{"metadata", "annotations", "deployment.kubernetes.io/revision"},
+}
+
+// normalize renders the object without its server managed fields
+func normalize(obj *unstructured.Unstructured) (string, error) {
+	if obj == nil {
+		return "", nil
+	}
+	obj = obj.DeepCopy()
+	for _, field := range serverFields {
+		unstructured.RemoveNestedField(obj.Object, field...)
+	}
+	if len(obj.GetAnnotations()) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+	}
+	out, err := yaml.Marshal(obj.Object)
+	return string(out), err
+}
+
+// Diff compares each live object against the result of a server-side
+// dry-run of the rendered spec, so that defaulted fields are not reported
+func (m *Manifest) Diff(ctx context.Context) (string, error) {
+	m.logger = log.WithFields(log.Fields{
+		"kind": "kubernetes",
+	})
+
+	specs, err := m.buildObjects()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, spec := range specs {
+		if spec == nil {
+			continue
+		} else if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		ri, err := m.resource(spec.GetObjectKind().GroupVersionKind())
+		if err != nil {
+			return "", err
+		}
+		unstruct, err := runtime.DefaultUnstructuredConverter.ToUnstructured(spec)
+		if err != nil {
+			return "", err
+		}
+		desired := &unstructured.Unstructured{Object: unstruct}
+		name := fmt.Sprintf("%s/%s", desired.GetKind(), desired.GetName())
+
+		live, err := ri.Get(desired.GetName(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			live = nil
+		} else if err != nil {
+			return "", fmt.Errorf("couldn't get %s: %v", name, err)
+		}
+
+		// fallback to the rendered spec if the server can't dry-run
+		if live == nil {
+			if dry, err := ri.Create(desired.DeepCopy(), metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}}); err == nil {
+				desired = dry
+			}
+		} else if dry, err := ri.Update(desired.DeepCopy(), metav1.UpdateOptions{DryRun: []string{metav1.DryRunAll}}); err == nil {
+			desired = dry
+		}
+
+		from, err := normalize(live)
+		if err != nil {
+			return "", err
+		}
+		to, err := normalize(desired)
+		if err != nil {
+			return "", err
+		}
+		out, err := util.Diff(from, to, "live/"+name, "desired/"+name)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(out)
+	}
+	return sb.String(), nil
 }
 
 // Delete the decoded kubernetes objects
-func (m *Manifest) Delete() error {
-	return m.Workflow(delete)
+func (m *Manifest) Delete(ctx context.Context) error {
+	return m.Workflow(ctx, delete)
 }
@@ -1,9 +1,21 @@
 package kube
 
 import (
+	"context"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dfake "k8s.io/client-go/dynamic/fake"
+	ktesting "k8s.io/client-go/testing"
 )
 
 func newTestManifest() Manifest {
@@ -42,17 +54,161 @@ func TestCreateDelete(t *testing.T) {
 	assert.NoError(t, err)
 
 	m.SetInput([]byte(testData))
-	err = m.InstallOrUpgrade()
+	err = m.InstallOrUpgrade(context.Background())
 	assert.NoError(t, err)
 
-	exists, err := m.Status()
+	exists, err := m.Status(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, true, exists)
 
-	err = m.Delete()
+	err = m.Delete(context.Background())
 	assert.NoError(t, err)
 
-	exists, err = m.Status()
+	exists, err = m.Status(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, false, exists)
 }
+
+func TestRollback(t *testing.T) {
+	m := newTestManifest()
+
+	err := m.K8s.CreateNamespace(m.Namespace)
+	assert.NoError(t, err)
+
+	// initial install creates both objects
+	m.SetInput([]byte(testData))
+	err = m.InstallOrUpgrade(context.Background())
+	assert.NoError(t, err)
+
+	err = m.Rollback(context.Background())
+	assert.NoError(t, err)
+	exists, err := m.Status(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, false, exists)
+
+	// an upgrade restores the previous data
+	err = m.InstallOrUpgrade(context.Background())
+	assert.NoError(t, err)
+	m.SetInput([]byte(strings.Replace(testData, `test: "data"`, `test: "ZGF0YQ=="`, -1)))
+	err = m.InstallOrUpgrade(context.Background())
+	assert.NoError(t, err)
+
+	err = m.Rollback(context.Background())
+	assert.NoError(t, err)
+	ri, err := m.resource(v1.SchemeGroupVersion.WithKind("ConfigMap"))
+	assert.NoError(t, err)
+	obj, err := ri.Get("config-data", metav1.GetOptions{})
+	require.NoError(t, err)
+	data, _, _ := unstructured.NestedString(obj.Object, "data", "test")
+	assert.Equal(t, "data", data)
+}
+
+func TestDiff(t *testing.T) {
+	m := newTestManifest()
+
+	err := m.K8s.CreateNamespace(m.Namespace)
+	assert.NoError(t, err)
+
+	m.SetInput([]byte(testData))
+	out, err := m.Diff(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, out, "+++ desired/ConfigMap/config-data")
+	assert.Contains(t, out, "+  test: data")
+	assert.NotContains(t, out, "creationTimestamp")
+
+	err = m.InstallOrUpgrade(context.Background())
+	assert.NoError(t, err)
+	out, err = m.Diff(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+
+	m.SetInput([]byte(strings.Replace(testData, `test: "data"`, `test: "ZGF0YQ=="`, -1)))
+	out, err = m.Diff(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, out, "--- live/ConfigMap/config-data")
+	assert.Contains(t, out, "-  test: data\n+  test: ZGF0YQ==")
+
+	// only a missing object is new
+	m.K8s.dynamic.(*dfake.FakeDynamicClient).PrependReactor("get", "*", func(ktesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "config-data", nil)
+	})
+	_, err = m.Diff(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "forbidden")
+}
+
+func TestNames(t *testing.T) {
+	m := newTestManifest()
+	m.SetInput([]byte(testData))
+	assert.Equal(t, []string{"Secret/secret-data", "ConfigMap/config-data"}, m.Names())
+}
+
+func TestParallel(t *testing.T) {
+	m := newTestManifest()
+	m.K8s.Parallel = 1
+	m.SetInput([]byte(testData))
+	require.NoError(t, m.InstallOrUpgrade(context.Background()))
+
+	exists, err := m.Status(context.Background())
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestLookup(t *testing.T) {
+	m := newTestManifest()
+	m.SetInput([]byte(strings.Replace(testData, `test: "data"`, `test: "ZGF0YQ=="`, -1)))
+	require.NoError(t, m.InstallOrUpgrade(context.Background()))
+
+	value, err := m.Lookup(context.Background(), "ConfigMap/config-data", "data.test")
+	require.NoError(t, err)
+	assert.Equal(t, "ZGF0YQ==", value)
+
+	// secret data is decoded
+	value, err = m.Lookup(context.Background(), "Secret/secret-data", "data.test")
+	require.NoError(t, err)
+	assert.Equal(t, "data", value)
+
+	_, err = m.Lookup(context.Background(), "ConfigMap/config-data", "data.missing")
+	assert.Error(t, err)
+	_, err = m.Lookup(context.Background(), "ConfigMap/other", "data.test")
+	assert.Error(t, err)
+}
+
+func TestScope(t *testing.T) {
+	m := newTestManifest()
+	m.K8s.typed.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{
+			{Name: "namespaces", Kind: "Namespace"},
+		}},
+		{GroupVersion: "example.com/v1", APIResources: []metav1.APIResource{
+			{Name: "widgets", Kind: "Widget", Namespaced: true},
+		}},
+	}
+	m.SetInput([]byte(`
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: tenant
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: gadget
+spec:
+  size: 3
+`))
+	require.NoError(t, m.InstallOrUpgrade(context.Background()))
+	assert.Equal(t, []string{"Namespace/tenant", "Widget/gadget"}, m.Names())
+
+	// cluster scoped objects have no namespace
+	_, err := m.K8s.dynamic.Resource(v1.SchemeGroupVersion.WithResource("namespaces")).Get("tenant", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	// custom resources are applied through the dynamic client
+	widgets := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+	_, err = m.K8s.dynamic.Resource(widgets).Namespace(m.Namespace).Get("gadget", metav1.GetOptions{})
+	assert.NoError(t, err)
+	value, err := m.Lookup(context.Background(), "Widget/gadget", "spec.size")
+	require.NoError(t, err)
+	assert.Equal(t, "3", value)
+}
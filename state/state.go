@@ -0,0 +1,174 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/monax/compass/kube"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Record describes the last time a stage was applied
+type Record struct {
+	Hash      string            `json:"hash"`                // fingerprint of the rendered stage
+	Run       int               `json:"run"`                 // run which applied it
+	Version   string            `json:"version,omitempty"`   // chart version, if any
+	Resources []string          `json:"resources,omitempty"` // objects or releases created
+	Outcome   string            `json:"outcome"`             // result of the apply
+	Outputs   map[string]string `json:"outputs,omitempty"`   // values printed by jobs
+	Applied   time.Time         `json:"applied"`             // when it finished
+	Snapshot  string            `json:"snapshot,omitempty"`  // manifest applied by a kube stage
+	History   []*Record         `json:"history,omitempty"`   // earlier successful records, oldest first
+}
+
+// Keep is the number of earlier records kept in the history of each stage
+const Keep = 5
+
+// State holds the latest record for each stage in a workflow
+type State struct {
+	Scroll string             `json:"scroll,omitempty"` // workflow which was run
+	Run    int                `json:"run"`              // number of runs so far
+	Stages map[string]*Record `json:"stages"`
+}
+
+// New returns an empty state
+func New() *State {
+	return &State{Stages: make(map[string]*Record)}
+}
+
+// Store persists the state between runs
+type Store interface {
+	Load() (*State, error)
+	Save(*State) error
+}
+
+// decode reads the state, an empty input is an empty state
+func decode(data []byte) (*State, error) {
+	st := New()
+	if len(data) == 0 {
+		return st, nil
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("couldn't read state: %v", err)
+	}
+	if st.Stages == nil {
+		st.Stages = make(map[string]*Record)
+	}
+	return st, nil
+}
+
+// File keeps the state on the local disk
+type File struct {
+	Path string
+}
+
+// Load reads the state file
+func (f *File) Load() (*State, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return New(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// Save replaces the state file
+func (f *File) Save(st *State) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	// write then rename so we never leave a partial file
+	tmp := f.Path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Path)
+}
+
+// key is the entry used in a ConfigMap or Secret
+const key = "state.json"
+
+// Cluster keeps the state in a ConfigMap or Secret
+type Cluster struct {
+	Secret    bool
+	Name      string
+	Namespace string
+	*kube.K8s
+}
+
+// Load reads the state from the cluster
+func (c *Cluster) Load() (*State, error) {
+	var data string
+	var err error
+	if c.Secret {
+		data, err = c.FromSecret(c.Name, c.Namespace, key)
+	} else {
+		data, err = c.FromConfigMap(c.Name, c.Namespace, key)
+	}
+	if apierrors.IsNotFound(err) {
+		return New(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decode([]byte(data))
+}
+
+// Save writes the state to the cluster
+func (c *Cluster) Save(st *State) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if c.Secret {
+		return c.ToSecret(c.Name, c.Namespace, key, string(data))
+	}
+	return c.ToConfigMap(c.Name, c.Namespace, key, string(data))
+}
+
+// Private returns true if the store can keep secret data, unlike a
+// ConfigMap which anyone who can read its namespace can see
+func Private(store Store) bool {
+	switch s := store.(type) {
+	case *File:
+		return true
+	case *Cluster:
+		return s.Secret
+	}
+	return false
+}
+
+// Open returns the store for a location such as file://path,
+// configmap://namespace/name or secret://namespace/name
+func Open(location string, k8s *kube.K8s) (Store, error) {
+	parts := strings.SplitN(location, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("state location '%s' not valid", location)
+	}
+
+	switch parts[0] {
+	case "file":
+		return &File{Path: parts[1]}, nil
+	case "configmap", "secret":
+		ref := strings.Split(parts[1], "/")
+		if len(ref) != 2 || ref[0] == "" || ref[1] == "" {
+			return nil, fmt.Errorf("state location '%s' should be %s://namespace/name", location, parts[0])
+		}
+		return &Cluster{
+			Secret:    parts[0] == "secret",
+			Namespace: ref[0],
+			Name:      ref[1],
+			K8s:       k8s,
+		}, nil
+	}
+	return nil, fmt.Errorf("state backend '%s' unknown", parts[0])
+}
@@ -0,0 +1,66 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/monax/compass/kube"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, store Store) {
+	st, err := store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, st.Stages)
+
+	applied := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	st.Stages["test"] = &Record{Hash: "abc", Version: "1.0.0", Outcome: "succeeded", Applied: applied}
+	require.NoError(t, store.Save(st))
+	require.NoError(t, store.Save(st))
+
+	st, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, &Record{Hash: "abc", Version: "1.0.0", Outcome: "succeeded", Applied: applied}, st.Stages["test"])
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compass")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testStore(t, &File{Path: filepath.Join(dir, "state", "test.json")})
+}
+
+func TestCluster(t *testing.T) {
+	k8s := kube.NewFakeClient()
+	testStore(t, &Cluster{Name: "compass", Namespace: "default", K8s: k8s})
+	testStore(t, &Cluster{Secret: true, Name: "compass", Namespace: "default", K8s: k8s})
+}
+
+func TestOpen(t *testing.T) {
+	store, err := Open("file://.compass/state.json", nil)
+	require.NoError(t, err)
+	assert.Equal(t, &File{Path: ".compass/state.json"}, store)
+
+	store, err = Open("secret://default/compass", nil)
+	require.NoError(t, err)
+	assert.Equal(t, &Cluster{Secret: true, Namespace: "default", Name: "compass"}, store)
+
+	_, err = Open("configmap://compass", nil)
+	assert.Error(t, err)
+	_, err = Open("s3://bucket", nil)
+	assert.Error(t, err)
+	_, err = Open(".compass/state.json", nil)
+	assert.Error(t, err)
+}
+
+func TestPrivate(t *testing.T) {
+	assert.True(t, Private(&File{Path: "state.json"}))
+	assert.True(t, Private(&Cluster{Secret: true}))
+	assert.False(t, Private(&Cluster{}))
+	assert.False(t, Private(nil))
+}
@@ -0,0 +1,17 @@
+package util
+
+import (
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Diff returns the unified difference between two texts,
+// or an empty string if they are the same
+func Diff(from, to, fromName, toName string) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(from),
+		B:        difflib.SplitLines(to),
+		FromFile: fromName,
+		ToFile:   toName,
+		Context:  3,
+	})
+}
@@ -3,6 +3,8 @@ package util
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -12,6 +14,7 @@ import (
 	"text/template"
 
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 )
 
 // IsDir returns true if the given path corresponds to a directory
@@ -82,6 +85,35 @@ func GetHead(path string) (string, error) {
 	return ref.Hash().String(), nil
 }
 
+// Checkout clones the repository into the given directory, replacing
+// anything already there, then checks out the branch, tag or commit
+func Checkout(ctx context.Context, url, ref, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	repo, err := git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{URL: url})
+	if err != nil {
+		return err
+	} else if ref == "" {
+		return nil
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		// only the default branch is tracked locally
+		if hash, err = repo.ResolveRevision(plumbing.Revision("origin/" + ref)); err != nil {
+			return fmt.Errorf("couldn't find %s in %s", ref, url)
+		}
+	}
+
+	tree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return tree.Checkout(&git.CheckoutOptions{Hash: *hash})
+}
+
 // RenderFile reads a file and templates it according to the provided functions
 func RenderFile(name string, v Values, funcs template.FuncMap) ([]byte, error) {
 	if name == "" {
@@ -0,0 +1,43 @@
+package util
+
+// Suggest returns the closest known name, if any are similar enough
+func Suggest(name string, known []string) string {
+	best, closest := "", len(name)/2+1
+	for _, key := range known {
+		if d := Distance(name, key); d < closest {
+			best, closest = key, d
+		}
+	}
+	return best
+}
+
+// Distance is the number of single character edits between two strings
+func Distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minimum(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minimum(values ...int) int {
+	least := values[0]
+	for _, v := range values[1:] {
+		if v < least {
+			least = v
+		}
+	}
+	return least
+}
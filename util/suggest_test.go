@@ -0,0 +1,15 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuggest(t *testing.T) {
+	assert.Equal(t, 0, Distance("db", "db"))
+	assert.Equal(t, 1, Distance("databse", "database"))
+	assert.Equal(t, 3, Distance("", "abc"))
+	assert.Equal(t, "database", Suggest("databse", []string{"api", "database"}))
+	assert.Equal(t, "", Suggest("cdn", []string{"api", "web"}))
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"text/template"
 
 	yaml "gopkg.in/yaml.v2"
@@ -105,6 +106,26 @@ func (v Values) ToSlice() []string {
 	return values
 }
 
+// Lookup finds a nested value by its dotted path, e.g. tenants.names
+func (v Values) Lookup(path string) (interface{}, bool) {
+	var current interface{} = v
+	for _, key := range strings.Split(path, ".") {
+		var ok bool
+		switch vv := current.(type) {
+		case Values:
+			current, ok = vv[key]
+		case map[interface{}]interface{}:
+			current, ok = vv[key]
+		case map[string]interface{}:
+			current, ok = vv[key]
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
 // Cascade returns the first non empty value
 func (v Values) Cascade(current, key, field string) string {
 	if current != "" {
@@ -153,3 +153,23 @@ func TestCascade(t *testing.T) {
 		assert.Equal(t, tt.expected, actual)
 	}
 }
+
+func TestLookup(t *testing.T) {
+	vals := Values{
+		"tenants": []interface{}{"one", "two"},
+		"nested":  map[string]interface{}{"names": map[interface{}]interface{}{"first": "a"}},
+	}
+
+	actual, ok := vals.Lookup("tenants")
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{"one", "two"}, actual)
+
+	actual, ok = vals.Lookup("nested.names.first")
+	assert.True(t, ok)
+	assert.Equal(t, "a", actual)
+
+	_, ok = vals.Lookup("nested.missing")
+	assert.False(t, ok)
+	_, ok = vals.Lookup("tenants.one")
+	assert.False(t, ok)
+}